@@ -0,0 +1,349 @@
+package eventbus
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/json"
+	"github.com/hzwesoft-github/underscore/lang"
+	"github.com/hzwesoft-github/underscore/openwrt"
+)
+
+// how long an event sent to ubus is expected back by default, see UbusBridge
+const UBUS_BRIDGE_ECHO_TIMEOUT = 5 * time.Second
+
+// maps the names of events between the bus and ubus, see UbusBridge
+type BridgeRule struct {
+	// name of the events to bridge, ending with "*" to match all with the
+	// prefix. outbound rules need an exact topic
+	Pattern string
+	// name of the bridged event, blank to keep it. a trailing "*" is replaced
+	// by what the "*" of Pattern matched, e.g. "network.interface.*" to "net.*"
+	Topic string
+	// decode the json payload of an inbound ubus event, into a map when nil
+	Decode func(msg string) (any, error)
+}
+
+// ContextData of the events republished by a bridge
+type UbusOrigin struct {
+	Bridge *UbusBridge
+	// id of the ubus event
+	Event string
+}
+
+/*
+Republish ubus events as local events and forward local topics to ubus, over
+the connection of Client.
+
+events from ubus are never forwarded back, and the events the bridge sends are
+not republished when they come back from ubusd within EchoTimeout. an echo that
+is lost, e.g. while reconnecting, is forgotten after that.
+*/
+type UbusBridge struct {
+	Client *openwrt.UbusClient
+	// ubus event patterns republished as local events
+	Inbound []BridgeRule
+	// local topics sent as ubus events
+	Outbound []BridgeRule
+	// deliver inbound events asynchronously, see SendLocal
+	Async bool
+	// UBUS_BRIDGE_ECHO_TIMEOUT when 0
+	EchoTimeout time.Duration
+
+	// serializes Start and Stop, the listeners are not registered under mutex
+	// as they take it
+	startMutex sync.Mutex
+	registered map[string]bool
+
+	// guards the fields below
+	mutex    sync.Mutex
+	running  bool
+	patterns []string
+	// stop the listeners of the patterns
+	stops []func() error
+	// deadlines of the events sent to ubus and expected back, by _EchoKey
+	echoes map[string][]time.Time
+}
+
+func NewUbusBridge(client *openwrt.UbusClient) *UbusBridge {
+	return &UbusBridge{Client: client}
+}
+
+// listen for the inbound patterns and forward the outbound topics
+func (b *UbusBridge) Start() error {
+	for _, rule := range b.Outbound {
+		if strings.HasSuffix(rule.Pattern, "*") {
+			return errors.New("ng: eventbus: outbound rules need an exact topic, got " + rule.Pattern)
+		}
+	}
+
+	b.startMutex.Lock()
+	defer b.startMutex.Unlock()
+
+	b.mutex.Lock()
+	running := b.running
+	b.mutex.Unlock()
+	if running {
+		return nil
+	}
+
+	// listened to along with the other users of the client, e.g. a gateway
+	patterns := make([]string, 0, len(b.Inbound))
+	stops := make([]func() error, 0, len(b.Inbound))
+	for _, rule := range b.Inbound {
+		if lang.EqualsAny(rule.Pattern, patterns...) {
+			continue
+		}
+
+		pattern := rule.Pattern
+		stop, err := b.Client.ListenEvent(pattern, func(event string, msg string) {
+			b.receive(pattern, event, msg)
+		})
+		if err != nil {
+			for _, stop := range stops {
+				stop()
+			}
+			return err
+		}
+		patterns = append(patterns, pattern)
+		stops = append(stops, stop)
+	}
+
+	// the bus can't drop a subscriber, stopped bridges ignore the events
+	if b.registered == nil {
+		b.registered = make(map[string]bool)
+	}
+	for _, rule := range b.Outbound {
+		if !b.registered[rule.Pattern] {
+			b.registered[rule.Pattern] = true
+			topic := rule.Pattern
+			Register(topic, func(event Event) error {
+				return b.send(topic, event)
+			})
+		}
+	}
+
+	b.mutex.Lock()
+	b.patterns, b.stops, b.echoes, b.running = patterns, stops, make(map[string][]time.Time), true
+	b.mutex.Unlock()
+
+	return nil
+}
+
+func (b *UbusBridge) Stop() error {
+	b.startMutex.Lock()
+	defer b.startMutex.Unlock()
+
+	b.mutex.Lock()
+	stops := b.stops
+	b.patterns, b.stops, b.running = nil, nil, false
+	b.mutex.Unlock()
+
+	var firstErr error
+	for _, stop := range stops {
+		if err := stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// republish an ubus event matching pattern
+func (b *UbusBridge) receive(pattern string, id string, msg string) {
+	b.mutex.Lock()
+	running, expecting := b.running, len(b.echoes) > 0
+	b.mutex.Unlock()
+
+	if !running || expecting && b.takeEcho(_EchoKey(id, msg)) {
+		return
+	}
+
+	for _, rule := range b.Inbound {
+		if rule.Pattern != pattern {
+			continue
+		}
+
+		topic, ok := rule.mapName(id)
+		if !ok {
+			continue
+		}
+
+		decode := rule.Decode
+		if decode == nil {
+			decode = DecodePayload[map[string]any]
+		}
+		payload, err := decode(msg)
+		if err != nil {
+			continue
+		}
+
+		SendLocal(Event{
+			Topic:       topic,
+			Payload:     payload,
+			ContextData: &UbusOrigin{Bridge: b, Event: id},
+			Local:       true,
+		}, b.Async)
+	}
+}
+
+// forward a local event of topic to ubus
+func (b *UbusBridge) send(topic string, event Event) error {
+	if origin, ok := event.ContextData.(*UbusOrigin); ok && origin.Bridge == b {
+		return nil
+	}
+
+	b.mutex.Lock()
+	running := b.running
+	b.mutex.Unlock()
+	if !running {
+		return nil
+	}
+
+	for _, rule := range b.Outbound {
+		if rule.Pattern != topic {
+			continue
+		}
+
+		id, _ := rule.mapName(topic)
+		key, err := b.expectEcho(id, event.Payload)
+		if err != nil {
+			return err
+		}
+		if err := b.Client.SendEvent(id, event.Payload); err != nil {
+			b.takeEcho(key)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remember an event that will come back through an inbound pattern, the key
+// is blank if it won't
+func (b *UbusBridge) expectEcho(id string, payload any) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	matched := false
+	for _, pattern := range b.patterns {
+		if _, ok := _MatchTopic(pattern, id); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", nil
+	}
+
+	// as the listener will see it
+	w := openwrt.NewBlobWriter()
+	if err := w.AddMessage(payload); err != nil {
+		return "", err
+	}
+	msg, err := openwrt.FormatBlobmsgJson(w.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	for key := range b.echoes {
+		b.expireEchoes(key, now)
+	}
+
+	timeout := b.EchoTimeout
+	if timeout <= 0 {
+		timeout = UBUS_BRIDGE_ECHO_TIMEOUT
+	}
+
+	key := _EchoKey(id, msg)
+	b.echoes[key] = append(b.echoes[key], now.Add(timeout))
+	return key, nil
+}
+
+// forget an expected event, false if it was not or its deadline passed
+func (b *UbusBridge) takeEcho(key string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.expireEchoes(key, time.Now()) {
+		return false
+	}
+
+	if b.echoes[key] = b.echoes[key][1:]; len(b.echoes[key]) == 0 {
+		delete(b.echoes, key)
+	}
+	return true
+}
+
+// drop the echoes of key past their deadline, false if none is left.
+// deadlines are kept in the order the events were sent
+func (b *UbusBridge) expireEchoes(key string, now time.Time) bool {
+	deadlines := b.echoes[key]
+	for len(deadlines) > 0 && now.After(deadlines[0]) {
+		deadlines = deadlines[1:]
+	}
+
+	if len(deadlines) == 0 {
+		delete(b.echoes, key)
+		return false
+	}
+
+	b.echoes[key] = deadlines
+	return true
+}
+
+// an event as compared between sent and received, libubus indents the json
+// of the events while the native client doesn't
+func _EchoKey(id string, msg string) string {
+	var payload any
+	if err := json.UnmarshalFromString(msg, &payload); err == nil {
+		if str, err := json.MarshalToString(payload); err == nil {
+			msg = str
+		}
+	}
+
+	return id + "\x00" + msg
+}
+
+// name of the bridged event, false if the rule doesn't match name
+func (rule *BridgeRule) mapName(name string) (string, bool) {
+	rest, ok := _MatchTopic(rule.Pattern, name)
+	if !ok {
+		return "", false
+	}
+
+	switch {
+	case rule.Topic == "":
+		return name, true
+	case strings.HasSuffix(rule.Topic, "*"):
+		return strings.TrimSuffix(rule.Topic, "*") + rest, true
+	default:
+		return rule.Topic, true
+	}
+}
+
+// whether name matches pattern like ubusd does, and what the "*" matched
+func _MatchTopic(pattern string, name string) (string, bool) {
+	if strings.HasSuffix(pattern, "*") {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix), true
+		}
+		return "", false
+	}
+
+	return "", pattern == name
+}
+
+// decode the json payload of an ubus event into a T, see BridgeRule.Decode
+func DecodePayload[T any](msg string) (any, error) {
+	var payload T
+	if err := json.UnmarshalFromString(msg, &payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,179 @@
+//go:build !cgo || ubus_native
+
+package eventbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+type bridgeLink struct {
+	Name string `json:"name"`
+}
+
+func TestUbusBridge(t *testing.T) {
+	broker := ubustest.Start(t)
+
+	client := broker.NewClient(t)
+	bridge := NewUbusBridge(client)
+	bridge.Inbound = []BridgeRule{
+		{Pattern: "network.interface.*", Topic: "bridge.net.*", Decode: DecodePayload[bridgeLink]},
+		{Pattern: "bridge.app.*"},
+	}
+	bridge.Outbound = []BridgeRule{{Pattern: "bridge.alarm", Topic: "bridge.app.alarm"}}
+	if err := bridge.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// another user of the client listening to the same pattern
+	others := make(chan string, 4)
+	stop, err := client.ListenEvent("network.interface.*", func(event string, msg string) {
+		others <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	events := make(chan Event, 4)
+	collect := func(event Event) error {
+		events <- event
+		return nil
+	}
+	Register("bridge.net.up", collect)
+	Register("bridge.app.alarm", collect)
+
+	sender := broker.NewClient(t)
+	if err := sender.SendEvent("network.interface.up", map[string]any{"name": "lan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		origin, _ := event.ContextData.(*UbusOrigin)
+		if event.Topic != "bridge.net.up" || event.Payload != (bridgeLink{"lan"}) || origin == nil || origin.Event != "network.interface.up" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// forwarded, and not republished when it comes back
+	if err := SendLocal(NewLocalEvent("bridge.alarm", map[string]any{"level": 2}, nil), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendEvent("bridge.app.alarm", map[string]any{"level": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Payload.(map[string]any)["level"] != float64(3) {
+			t.Errorf("the echo of the bridge was republished, %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	sent := broker.Events()
+	if len(sent) != 3 || sent[1].Id != "bridge.app.alarm" || sent[1].Data["level"] != int32(2) {
+		t.Errorf("unexpected ubus events %+v", sent)
+	}
+
+	if err := bridge.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	sender.SendEvent("network.interface.up", map[string]any{"name": "wan"})
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event after stop %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the other listener got both, and still listens
+	for i := 0; i < 2; i++ {
+		if got := ubustest.Wait(t, others); got != "network.interface.up" {
+			t.Errorf("unexpected event %s", got)
+		}
+	}
+}
+
+func TestUbusBridgeLostEcho(t *testing.T) {
+	broker := ubustest.Start(t)
+
+	bridge := NewUbusBridge(broker.NewClient(t))
+	bridge.Inbound = []BridgeRule{{Pattern: "bridge.lost.*"}}
+	bridge.EchoTimeout = 50 * time.Millisecond
+	if err := bridge.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bridge.Stop()
+
+	events := make(chan Event, 4)
+	Register("bridge.lost.event", func(event Event) error {
+		events <- event
+		return nil
+	})
+
+	// sent by the bridge but never seen back
+	if _, err := bridge.expectEcho("bridge.lost.event", map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the same event from another client once the echo expired
+	sender := broker.NewClient(t)
+	if err := sender.SendEvent("bridge.lost.event", map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if event := ubustest.Wait(t, events); event.Topic != "bridge.lost.event" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	bridge.mutex.Lock()
+	pending := len(bridge.echoes)
+	bridge.mutex.Unlock()
+	if pending != 0 {
+		t.Errorf("expect no pending echoes, got %d", pending)
+	}
+}
+
+func TestBridgeRuleMapName(t *testing.T) {
+	cases := []struct {
+		rule   BridgeRule
+		name   string
+		expect string
+		ok     bool
+	}{
+		{BridgeRule{Pattern: "network.*", Topic: "net.*"}, "network.interface.up", "net.interface.up", true},
+		{BridgeRule{Pattern: "network.*", Topic: "net"}, "network.interface.up", "net", true},
+		{BridgeRule{Pattern: "network.*"}, "network.interface.up", "network.interface.up", true},
+		{BridgeRule{Pattern: "network.*"}, "system.boot", "", false},
+		{BridgeRule{Pattern: "alarm", Topic: "app.alarm"}, "alarm", "app.alarm", true},
+	}
+
+	for _, c := range cases {
+		if got, ok := c.rule.mapName(c.name); got != c.expect || ok != c.ok {
+			t.Errorf("%+v %s: expect %s %v, got %s %v", c.rule, c.name, c.expect, c.ok, got, ok)
+		}
+	}
+
+	bridge := NewUbusBridge(nil)
+	bridge.Outbound = []BridgeRule{{Pattern: "app.*"}}
+	if err := bridge.Start(); err == nil {
+		t.Error("expect an error for a pattern in an outbound rule")
+	}
+}
+
+func TestBridgeEchoKey(t *testing.T) {
+	compact := _EchoKey("alarm", `{"level":2,"tags":["a","b"]}`)
+	indented := _EchoKey("alarm", "{\n\t\"tags\": [\n\t\t\"a\",\n\t\t\"b\"\n\t],\n\t\"level\": 2\n}")
+	if compact != indented {
+		t.Errorf("expect the same key, got %q and %q", compact, indented)
+	}
+	if compact == _EchoKey("alarm", `{"level":3,"tags":["a","b"]}`) || compact == _EchoKey("other", `{"level":2,"tags":["a","b"]}`) {
+		t.Error("expect another key for another event")
+	}
+}
@@ -0,0 +1,12 @@
+package eventbus
+
+import (
+	"github.com/hzwesoft-github/underscore/openwrt"
+)
+
+// publish uci audit records as events on topic, payload is *openwrt.UciAuditRecord
+func UciAuditSink(topic string, local, remote bool) openwrt.UciAuditFunc {
+	return func(record *openwrt.UciAuditRecord) error {
+		return SendEvent(NewEvent(topic, record, nil, local, remote), false)
+	}
+}
@@ -30,14 +30,15 @@ type TestMessage struct {
 	F2 int32  `json:"f2"`
 }
 
-func ubusHandler(obj string, method string, req *openwrt.UbusRequestData, msg string) {
+func ubusHandler(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
 	fmt.Printf("server received: %s\n", msg)
-	isclient.SendReply(req, msg)
+	return isclient.SendReply(req, msg)
 }
 
-func ubusDataHandler(msg string) {
+func ubusDataHandler(msg string) error {
 	fmt.Printf("client received: %s\n", msg)
 	fmt.Println()
+	return nil
 }
 
 func ubusEventHandler(event string, msg string) {
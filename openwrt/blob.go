@@ -0,0 +1,494 @@
+package openwrt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hzwesoft-github/underscore/json"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// pure go blob_attr and blobmsg encoding of libubox, what ubusd speaks on the wire
+
+const (
+	blobAttrExtended = 0x80000000
+	blobAttrIdMask   = 0x7f000000
+	blobAttrIdShift  = 24
+	blobAttrLenMask  = 0x00ffffff
+	blobAttrHdrLen   = 4
+	blobAttrAlign    = 4
+)
+
+// enum blobmsg_type as sent on the wire, bool is sent as int8
+const (
+	blobmsgWireUnspec = iota
+	blobmsgWireArray
+	blobmsgWireTable
+	blobmsgWireString
+	blobmsgWireInt64
+	blobmsgWireInt32
+	blobmsgWireInt16
+	blobmsgWireInt8
+	blobmsgWireDouble
+)
+
+func (typ BlobmsgType) wireType() int {
+	switch typ {
+	case BLOBMSG_TYPE_ARRAY:
+		return blobmsgWireArray
+	case BLOBMSG_TYPE_TABLE:
+		return blobmsgWireTable
+	case BLOBMSG_TYPE_STRING:
+		return blobmsgWireString
+	case BLOBMSG_TYPE_INT64:
+		return blobmsgWireInt64
+	case BLOBMSG_TYPE_INT32:
+		return blobmsgWireInt32
+	case BLOBMSG_TYPE_INT16:
+		return blobmsgWireInt16
+	case BLOBMSG_TYPE_INT8, BLOBMSG_TYPE_BOOL:
+		return blobmsgWireInt8
+	case BLOBMSG_TYPE_DOUBLE:
+		return blobmsgWireDouble
+	default:
+		return blobmsgWireUnspec
+	}
+}
+
+func _BlobPadLen(size int) int {
+	return (size + blobAttrAlign - 1) &^ (blobAttrAlign - 1)
+}
+
+// one blob_attr. Name is only set for blobmsg attributes (Extended), whose Id is
+// the blobmsg type on the wire
+type BlobAttr struct {
+	Id       int
+	Extended bool
+	Name     string
+	Data     []byte
+}
+
+// parse the attributes packed in data, e.g. the payload of a table
+func ParseBlobAttrs(data []byte) ([]BlobAttr, error) {
+	attrs := make([]BlobAttr, 0)
+
+	for len(data) > 0 {
+		if len(data) < blobAttrHdrLen {
+			return nil, errors.New("ng: truncated blob attribute")
+		}
+
+		idLen := binary.BigEndian.Uint32(data)
+		size := int(idLen & blobAttrLenMask)
+		if size < blobAttrHdrLen || size > len(data) {
+			return nil, errors.New("ng: invalid blob attribute length")
+		}
+
+		attr := BlobAttr{
+			Id:       int((idLen & blobAttrIdMask) >> blobAttrIdShift),
+			Extended: idLen&blobAttrExtended != 0,
+			Data:     data[blobAttrHdrLen:size],
+		}
+
+		if attr.Extended {
+			if len(attr.Data) < 3 {
+				return nil, errors.New("ng: truncated blobmsg header")
+			}
+
+			nameLen := int(binary.BigEndian.Uint16(attr.Data))
+			hdrLen := _BlobPadLen(2 + nameLen + 1)
+			if hdrLen > len(attr.Data) {
+				return nil, errors.New("ng: invalid blobmsg name length")
+			}
+
+			attr.Name = string(attr.Data[2 : 2+nameLen])
+			attr.Data = attr.Data[hdrLen:]
+		}
+
+		attrs = append(attrs, attr)
+
+		if next := _BlobPadLen(size); next < len(data) {
+			data = data[next:]
+		} else {
+			data = nil
+		}
+	}
+
+	return attrs, nil
+}
+
+// type of a blobmsg attribute, int8 can't be told from bool
+func (attr *BlobAttr) Type() BlobmsgType {
+	return _BlobmsgTypeOfWire(attr.Id)
+}
+
+func _BlobmsgTypeOfWire(id int) BlobmsgType {
+	switch id {
+	case blobmsgWireArray:
+		return BLOBMSG_TYPE_ARRAY
+	case blobmsgWireTable:
+		return BLOBMSG_TYPE_TABLE
+	case blobmsgWireString:
+		return BLOBMSG_TYPE_STRING
+	case blobmsgWireInt64:
+		return BLOBMSG_TYPE_INT64
+	case blobmsgWireInt32:
+		return BLOBMSG_TYPE_INT32
+	case blobmsgWireInt16:
+		return BLOBMSG_TYPE_INT16
+	case blobmsgWireInt8:
+		return BLOBMSG_TYPE_INT8
+	case blobmsgWireDouble:
+		return BLOBMSG_TYPE_DOUBLE
+	default:
+		return BLOBMSG_TYPE_UNSPEC
+	}
+}
+
+func (attr *BlobAttr) GetUint8() uint8 {
+	if len(attr.Data) < 1 {
+		return 0
+	}
+	return attr.Data[0]
+}
+
+func (attr *BlobAttr) GetUint16() uint16 {
+	if len(attr.Data) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(attr.Data)
+}
+
+func (attr *BlobAttr) GetUint32() uint32 {
+	if len(attr.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(attr.Data)
+}
+
+func (attr *BlobAttr) GetUint64() uint64 {
+	if len(attr.Data) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(attr.Data)
+}
+
+func (attr *BlobAttr) GetDouble() float64 {
+	return math.Float64frombits(attr.GetUint64())
+}
+
+func (attr *BlobAttr) GetBool() bool {
+	return attr.GetUint8() != 0
+}
+
+// string without the terminating NUL
+func (attr *BlobAttr) GetString() string {
+	return strings.TrimRight(string(attr.Data), "\x00")
+}
+
+// the attributes nested in a table, array or nested plain attribute
+func (attr *BlobAttr) Children() ([]BlobAttr, error) {
+	return ParseBlobAttrs(attr.Data)
+}
+
+// builds packed blob attributes, the counterpart of struct blob_buf.
+// Bytes returns the attributes without an enclosing header
+type BlobWriter struct {
+	buf []byte
+}
+
+func NewBlobWriter() *BlobWriter {
+	return &BlobWriter{buf: make([]byte, 0, 256)}
+}
+
+func (w *BlobWriter) Bytes() []byte {
+	return w.buf
+}
+
+func (w *BlobWriter) Len() int {
+	return len(w.buf)
+}
+
+func (w *BlobWriter) Reset() {
+	w.buf = w.buf[:0]
+}
+
+func (w *BlobWriter) pad() {
+	for len(w.buf)%blobAttrAlign != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *BlobWriter) putHeader(idLen uint32) int {
+	offset := len(w.buf)
+	w.buf = binary.BigEndian.AppendUint32(w.buf, idLen)
+	return offset
+}
+
+// fix the length of the attribute started at offset and pad it
+func (w *BlobWriter) closeAt(offset int) {
+	idLen := binary.BigEndian.Uint32(w.buf[offset:])
+	idLen = idLen&^blobAttrLenMask | uint32(len(w.buf)-offset)&blobAttrLenMask
+	binary.BigEndian.PutUint32(w.buf[offset:], idLen)
+	w.pad()
+}
+
+// * plain attributes, as used by the ubus message
+
+func (w *BlobWriter) Put(id int, data []byte) {
+	offset := w.putHeader(uint32(id) << blobAttrIdShift)
+	w.buf = append(w.buf, data...)
+	w.closeAt(offset)
+}
+
+func (w *BlobWriter) PutUint8(id int, v uint8) {
+	w.Put(id, []byte{v})
+}
+
+func (w *BlobWriter) PutUint32(id int, v uint32) {
+	w.Put(id, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *BlobWriter) PutString(id int, v string) {
+	w.Put(id, append([]byte(v), 0))
+}
+
+// start a nested attribute, attributes written until Close(offset) are its payload
+func (w *BlobWriter) Nest(id int) int {
+	return w.putHeader(uint32(id) << blobAttrIdShift)
+}
+
+func (w *BlobWriter) Close(offset int) {
+	w.closeAt(offset)
+}
+
+// * blobmsg attributes
+
+func (w *BlobWriter) putMsgHeader(typ BlobmsgType, name string) int {
+	offset := w.putHeader(blobAttrExtended | uint32(typ.wireType())<<blobAttrIdShift)
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(name)))
+	w.buf = append(w.buf, name...)
+	w.buf = append(w.buf, 0)
+	w.pad()
+	return offset
+}
+
+func (w *BlobWriter) PutMsg(typ BlobmsgType, name string, data []byte) {
+	offset := w.putMsgHeader(typ, name)
+	w.buf = append(w.buf, data...)
+	w.closeAt(offset)
+}
+
+func (w *BlobWriter) PutMsgString(name string, v string) {
+	w.PutMsg(BLOBMSG_TYPE_STRING, name, append([]byte(v), 0))
+}
+
+func (w *BlobWriter) PutMsgBool(name string, v bool) {
+	var b uint8
+	if v {
+		b = 1
+	}
+	w.PutMsg(BLOBMSG_TYPE_BOOL, name, []byte{b})
+}
+
+func (w *BlobWriter) PutMsgInt8(name string, v int8) {
+	w.PutMsg(BLOBMSG_TYPE_INT8, name, []byte{uint8(v)})
+}
+
+func (w *BlobWriter) PutMsgInt16(name string, v int16) {
+	w.PutMsg(BLOBMSG_TYPE_INT16, name, binary.BigEndian.AppendUint16(nil, uint16(v)))
+}
+
+func (w *BlobWriter) PutMsgInt32(name string, v int32) {
+	w.PutMsg(BLOBMSG_TYPE_INT32, name, binary.BigEndian.AppendUint32(nil, uint32(v)))
+}
+
+func (w *BlobWriter) PutMsgInt64(name string, v int64) {
+	w.PutMsg(BLOBMSG_TYPE_INT64, name, binary.BigEndian.AppendUint64(nil, uint64(v)))
+}
+
+func (w *BlobWriter) PutMsgDouble(name string, v float64) {
+	w.PutMsg(BLOBMSG_TYPE_DOUBLE, name, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+// start a table, members written until Close(offset) belong to it
+func (w *BlobWriter) OpenTable(name string) int {
+	return w.putMsgHeader(BLOBMSG_TYPE_TABLE, name)
+}
+
+// start an array, members written until Close(offset) belong to it and
+// should have blank names
+func (w *BlobWriter) OpenArray(name string) int {
+	return w.putMsgHeader(BLOBMSG_TYPE_ARRAY, name)
+}
+
+// * json
+
+// same as BlobBuf.AddJsonFrom
+func (w *BlobWriter) AddJsonFrom(obj any) error {
+	if obj == nil {
+		return nil
+	}
+
+	switch v := obj.(type) {
+	case string:
+		return w.AddJsonFromString(v)
+	default:
+		ret, err := json.MarshalToString(obj)
+		if err != nil {
+			return err
+		}
+
+		return w.AddJsonFromString(ret)
+	}
+}
+
+// add the members of a json object, like blobmsg_add_json_from_string: integers
+// become int32 or int64 depending on their value, member order is kept
+func (w *BlobWriter) AddJsonFromString(str string) error {
+	iter := jsoniter.ParseString(jsoniter.ConfigDefault, str)
+	if iter.WhatIsNext() != jsoniter.ObjectValue {
+		return errors.New("ng: blobmsg json must be an object")
+	}
+
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+		w.addJsonValue(iter, field)
+		return iter.Error == nil
+	})
+
+	return iter.Error
+}
+
+func (w *BlobWriter) addJsonValue(iter *jsoniter.Iterator, name string) {
+	switch iter.WhatIsNext() {
+	case jsoniter.StringValue:
+		w.PutMsgString(name, iter.ReadString())
+	case jsoniter.NumberValue:
+		w.addJsonNumber(name, string(iter.ReadNumber()))
+	case jsoniter.BoolValue:
+		w.PutMsgBool(name, iter.ReadBool())
+	case jsoniter.NilValue:
+		iter.ReadNil()
+		w.PutMsg(BLOBMSG_TYPE_UNSPEC, name, nil)
+	case jsoniter.ArrayValue:
+		offset := w.OpenArray(name)
+		iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+			w.addJsonValue(iter, "")
+			return iter.Error == nil
+		})
+		w.Close(offset)
+	case jsoniter.ObjectValue:
+		offset := w.OpenTable(name)
+		iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+			w.addJsonValue(iter, field)
+			return iter.Error == nil
+		})
+		w.Close(offset)
+	default:
+		iter.ReportError("blobmsg", "invalid json value")
+	}
+}
+
+func (w *BlobWriter) addJsonNumber(name string, number string) {
+	if !strings.ContainsAny(number, ".eE") {
+		if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				w.PutMsgInt32(name, int32(i))
+			} else {
+				w.PutMsgInt64(name, i)
+			}
+			return
+		}
+	}
+
+	f, _ := strconv.ParseFloat(number, 64)
+	w.PutMsgDouble(name, f)
+}
+
+// format packed blobmsg attributes as a json object, like blobmsg_format_json
+// does for the payload of a table. int8 is formatted as bool
+func FormatBlobmsgJson(data []byte) (string, error) {
+	attrs, err := ParseBlobAttrs(data)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	if err := _FormatBlobmsgJson(&builder, attrs, false); err != nil {
+		return "", err
+	}
+
+	return builder.String(), nil
+}
+
+func _FormatBlobmsgJson(builder *strings.Builder, attrs []BlobAttr, array bool) error {
+	if array {
+		builder.WriteString("[")
+	} else {
+		builder.WriteString("{")
+	}
+
+	for i := range attrs {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+
+		if !array {
+			name, _ := json.MarshalToString(attrs[i].Name)
+			builder.WriteString(name)
+			builder.WriteString(":")
+		}
+
+		if err := _FormatBlobmsgValue(builder, &attrs[i]); err != nil {
+			return err
+		}
+	}
+
+	if array {
+		builder.WriteString("]")
+	} else {
+		builder.WriteString("}")
+	}
+
+	return nil
+}
+
+func _FormatBlobmsgValue(builder *strings.Builder, attr *BlobAttr) error {
+	switch attr.Id {
+	case blobmsgWireArray, blobmsgWireTable:
+		children, err := attr.Children()
+		if err != nil {
+			return err
+		}
+		return _FormatBlobmsgJson(builder, children, attr.Id == blobmsgWireArray)
+	case blobmsgWireString:
+		str, _ := json.MarshalToString(attr.GetString())
+		builder.WriteString(str)
+	case blobmsgWireInt64:
+		builder.WriteString(strconv.FormatInt(int64(attr.GetUint64()), 10))
+	case blobmsgWireInt32:
+		builder.WriteString(strconv.FormatInt(int64(int32(attr.GetUint32())), 10))
+	case blobmsgWireInt16:
+		builder.WriteString(strconv.FormatInt(int64(int16(attr.GetUint16())), 10))
+	case blobmsgWireInt8:
+		builder.WriteString(strconv.FormatBool(attr.GetBool()))
+	case blobmsgWireDouble:
+		f := attr.GetDouble()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			builder.WriteString("null")
+		} else {
+			str := strconv.FormatFloat(f, 'g', -1, 64)
+			if !strings.ContainsAny(str, ".e") {
+				// keep it a double when parsed back
+				str += ".0"
+			}
+			builder.WriteString(str)
+		}
+	default:
+		builder.WriteString("null")
+	}
+
+	return nil
+}
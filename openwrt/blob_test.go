@@ -0,0 +1,169 @@
+package openwrt
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestBlobWriter(t *testing.T) {
+	w := NewBlobWriter()
+	w.PutMsgInt32("a", 1)
+
+	// same as blobmsg_add_u32(&b, "a", 1)
+	expect := []byte{0x85, 0x00, 0x00, 0x0c, 0x00, 0x01, 'a', 0x00, 0x00, 0x00, 0x00, 0x01}
+	if !bytes.Equal(w.Bytes(), expect) {
+		t.Errorf("expect % x, got % x", expect, w.Bytes())
+	}
+}
+
+func TestBlobmsgJson(t *testing.T) {
+	str := `{"name":"lan","up":true,"mtu":1500,"rx":8589934592,"load":0.5,"ratio":2.0,"dns":["1.1.1.1","8.8.8.8"],"ipv4":{"address":"192.168.1.1","mask":24},"none":null}`
+
+	w := NewBlobWriter()
+	if err := w.AddJsonFromString(str); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := ParseBlobAttrs(w.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []BlobmsgType{
+		BLOBMSG_TYPE_STRING, BLOBMSG_TYPE_INT8, BLOBMSG_TYPE_INT32, BLOBMSG_TYPE_INT64, BLOBMSG_TYPE_DOUBLE,
+		BLOBMSG_TYPE_DOUBLE, BLOBMSG_TYPE_ARRAY, BLOBMSG_TYPE_TABLE, BLOBMSG_TYPE_UNSPEC,
+	}
+	if len(attrs) != len(types) {
+		t.Fatalf("expect %d attributes, got %d", len(types), len(attrs))
+	}
+	for i, attr := range attrs {
+		if attr.Type() != types[i] {
+			t.Errorf("%s: expect type %d, got %d", attr.Name, types[i], attr.Type())
+		}
+	}
+
+	ret, err := FormatBlobmsgJson(w.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != str {
+		t.Errorf("expect %s, got %s", str, ret)
+	}
+
+	if err := NewBlobWriter().AddJsonFromString(`[1, 2]`); err == nil {
+		t.Errorf("expect error for json array")
+	}
+}
+
+type testBlobmsgAddress struct {
+	Address string `json:"address"`
+	Mask    int8   `json:"mask"`
+}
+
+type testBlobmsgInterface struct {
+	Name    string                `blobmsg:"name"`
+	Up      bool                  `json:"up"`
+	Mtu     int                   `json:"mtu"`
+	Rx      int                   `blobmsg:"rx,int64"`
+	Load    float64               `json:"load"`
+	Metric  uint16                `json:"metric,omitempty"`
+	Dns     []string              `json:"dns"`
+	Ipv4    *testBlobmsgAddress   `json:"ipv4"`
+	Extra   map[string]any        `json:"extra,omitempty"`
+	Ignored string                `json:"-"`
+	Routes  []*testBlobmsgAddress `json:"routes"`
+}
+
+func TestBlobmsgCodec(t *testing.T) {
+	in := testBlobmsgInterface{
+		Name:    "lan",
+		Up:      true,
+		Mtu:     1500,
+		Rx:      12,
+		Load:    0.5,
+		Dns:     []string{"1.1.1.1"},
+		Ipv4:    &testBlobmsgAddress{"192.168.1.1", 24},
+		Ignored: "x",
+		Routes:  []*testBlobmsgAddress{{"10.0.0.0", 8}},
+	}
+
+	data, err := BlobmsgMarshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, _ := ParseBlobAttrs(data)
+	types := map[string]BlobmsgType{
+		"name": BLOBMSG_TYPE_STRING, "up": BLOBMSG_TYPE_INT8, "mtu": BLOBMSG_TYPE_INT32, "rx": BLOBMSG_TYPE_INT64,
+		"load": BLOBMSG_TYPE_DOUBLE, "dns": BLOBMSG_TYPE_ARRAY, "ipv4": BLOBMSG_TYPE_TABLE, "routes": BLOBMSG_TYPE_ARRAY,
+	}
+	if len(attrs) != len(types) {
+		t.Fatalf("expect %d attributes, got %d", len(types), len(attrs))
+	}
+	for _, attr := range attrs {
+		if types[attr.Name] != attr.Type() {
+			t.Errorf("%s: expect type %d, got %d", attr.Name, types[attr.Name], attr.Type())
+		}
+	}
+
+	var out testBlobmsgInterface
+	if err := BlobmsgUnmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != in.Name || !out.Up || out.Mtu != in.Mtu || out.Rx != in.Rx || out.Load != in.Load ||
+		len(out.Dns) != 1 || out.Ipv4 == nil || *out.Ipv4 != *in.Ipv4 || out.Ignored != "" || len(out.Routes) != 1 {
+		t.Errorf("unexpected %+v", out)
+	}
+
+	var generic map[string]any
+	if err := BlobmsgUnmarshal(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic["up"] != true || generic["mtu"] != int32(1500) || generic["rx"] != int64(12) {
+		t.Errorf("unexpected %v", generic)
+	}
+
+	var mismatch struct {
+		Name int `json:"name"`
+	}
+	if err := BlobmsgUnmarshal(data, &mismatch); err == nil {
+		t.Errorf("expect error decoding string into int")
+	}
+}
+
+func TestBlobmsgIntTypes(t *testing.T) {
+	type ints struct {
+		I8     int8   `json:"i8"`
+		U8     uint8  `json:"u8"`
+		I16    int16  `json:"i16"`
+		U16    uint16 `json:"u16"`
+		U32    uint32 `json:"u32"`
+		Narrow uint8  `blobmsg:"narrow,int8"`
+	}
+
+	in := ints{I8: -1, U8: 200, I16: -300, U16: 60000, U32: math.MaxUint32, Narrow: 1}
+	data, err := BlobmsgMarshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, _ := ParseBlobAttrs(data)
+	types := map[string]BlobmsgType{
+		"i8": BLOBMSG_TYPE_INT32, "u8": BLOBMSG_TYPE_INT32, "i16": BLOBMSG_TYPE_INT32, "u16": BLOBMSG_TYPE_INT32,
+		"u32": BLOBMSG_TYPE_INT64, "narrow": BLOBMSG_TYPE_INT8,
+	}
+	for _, attr := range attrs {
+		if types[attr.Name] != attr.Type() {
+			t.Errorf("%s: expect type %d, got %d", attr.Name, types[attr.Name], attr.Type())
+		}
+	}
+
+	var out ints
+	if err := BlobmsgUnmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("expect %+v, got %+v", in, out)
+	}
+}
@@ -1,3 +1,5 @@
+//go:build cgo && !ubus_native
+
 package openwrt
 
 /*
@@ -58,3 +60,31 @@ func (buf *BlobBuf) AddJsonFromString(str string) error {
 	_, err := C.blobmsg_add_json_from_string(buf.ptr, cstr)
 	return err
 }
+
+// add the members of a struct or map, see BlobmsgMarshal
+func (buf *BlobBuf) AddValue(v any) error {
+	data, err := BlobmsgMarshal(v)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > 0 {
+		C.blob_put_raw(buf.ptr, unsafe.Pointer(&data[0]), C.uint(len(data)))
+	}
+
+	return nil
+}
+
+// a json string, or any other value through AddValue
+func (buf *BlobBuf) AddMessage(msg any) error {
+	if str, ok := msg.(string); ok {
+		return buf.AddJsonFromString(str)
+	}
+
+	return buf.AddValue(msg)
+}
+
+// the attributes added so far, the payload of the buffer's table
+func (buf *BlobBuf) Bytes() []byte {
+	return C.GoBytes(C.blob_data(buf.ptr.head), C.int(C.blob_len(buf.ptr.head)))
+}
@@ -0,0 +1,729 @@
+package openwrt
+
+import (
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hzwesoft-github/underscore/json"
+)
+
+/*
+Encoding of go values to blobmsg and back without a json round trip.
+
+struct fields are named by the blobmsg tag, or the json tag when there is none,
+with the same "-" and omitempty rules. the blobmsg tag may fix the type of a
+number field, e.g. `blobmsg:"rx_bytes,int64"`, otherwise
+
+	bool                  BLOBMSG_TYPE_BOOL
+	int8, int16, int32    BLOBMSG_TYPE_INT32
+	uint8, uint16         BLOBMSG_TYPE_INT32
+	int64, uint32, uint64 BLOBMSG_TYPE_INT64
+	int, uint             BLOBMSG_TYPE_INT32, INT64 when the value doesn't fit
+	float32, float64      BLOBMSG_TYPE_DOUBLE
+	string, []byte        BLOBMSG_TYPE_STRING, []byte base64 encoded
+	slice, array          BLOBMSG_TYPE_ARRAY
+	struct, map           BLOBMSG_TYPE_TABLE
+	nil                   BLOBMSG_TYPE_UNSPEC
+
+small integers are widened since blobmsg_format_json renders INT8 as a bool,
+uint32 since blobmsg integers are signed. use the int8 or int16 tag option
+where a peer insists on the narrow type.
+
+values implementing json.Marshaler or encoding.TextMarshaler are encoded through
+them. decoding into an interface yields map[string]any, []any, string, bool,
+int16, int32, int64, float64 or nil
+*/
+
+var (
+	blobmsgFieldCache sync.Map
+
+	jsonMarshalerType   = reflect.TypeOf((*_JsonMarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*_JsonUnmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// same as json.Marshaler and json.Unmarshaler of the standard library
+type _JsonMarshaler interface {
+	MarshalJSON() ([]byte, error)
+}
+
+type _JsonUnmarshaler interface {
+	UnmarshalJSON(data []byte) error
+}
+
+// encode the members of a struct or map as packed blobmsg attributes, the
+// payload of a table
+func BlobmsgMarshal(v any) ([]byte, error) {
+	w := NewBlobWriter()
+	if err := w.AddValue(v); err != nil {
+		return nil, err
+	}
+
+	return w.Bytes(), nil
+}
+
+// decode packed blobmsg attributes, e.g. the arguments of a method, into the
+// struct, map or interface v points to
+func BlobmsgUnmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("ng: blobmsg: decode into non-pointer %T", v)
+	}
+
+	attrs, err := ParseBlobAttrs(data)
+	if err != nil {
+		return err
+	}
+
+	return _DecodeBlobmsgTable(attrs, rv.Elem())
+}
+
+// add the members of a struct or map
+func (w *BlobWriter) AddValue(v any) error {
+	rv := _IndirectBlobmsgValue(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		return nil
+	}
+
+	if rv.CanInterface() && rv.Type().Implements(jsonMarshalerType) {
+		ret, err := rv.Interface().(_JsonMarshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return w.AddJsonFromString(string(ret))
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct, reflect.Map:
+		return w.addMembers(rv)
+	default:
+		return fmt.Errorf("ng: blobmsg: %s is not a table", rv.Type())
+	}
+}
+
+// add v as one attribute
+func (w *BlobWriter) PutMsgValue(name string, v any) error {
+	return w.putValue(name, reflect.ValueOf(v), "")
+}
+
+// a json string, or any other value through AddValue
+func (w *BlobWriter) AddMessage(msg any) error {
+	if str, ok := msg.(string); ok {
+		return w.AddJsonFromString(str)
+	}
+
+	return w.AddValue(msg)
+}
+
+func _IndirectBlobmsgValue(rv reflect.Value) reflect.Value {
+	for rv.IsValid() && (rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+
+	return rv
+}
+
+func (w *BlobWriter) addMembers(rv reflect.Value) error {
+	if rv.Kind() == reflect.Map {
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("ng: blobmsg: unsupported map key %s", rv.Type().Key())
+		}
+
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		for _, key := range keys {
+			if err := w.putValue(key.String(), rv.MapIndex(key), ""); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, field := range _BlobmsgFields(rv.Type()) {
+		if field.skipEncode {
+			continue
+		}
+
+		fv, ok := _BlobmsgFieldByIndex(rv, field.index)
+		if !ok || (field.omitEmpty && fv.IsZero()) {
+			continue
+		}
+
+		if err := w.putValue(field.name, fv, field.typ); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *BlobWriter) putValue(name string, rv reflect.Value, typ string) error {
+	for rv.IsValid() && rv.Kind() == reflect.Interface && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	if rv.IsValid() && rv.Type().Implements(jsonMarshalerType) && !(rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		ret, err := rv.Interface().(_JsonMarshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return w.addJsonBytes(name, ret)
+	}
+	if rv.IsValid() && rv.Type().Implements(textMarshalerType) && !(rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		ret, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		w.PutMsgString(name, string(ret))
+		return nil
+	}
+
+	rv = _IndirectBlobmsgValue(rv)
+	if !rv.IsValid() {
+		w.PutMsg(BLOBMSG_TYPE_UNSPEC, name, nil)
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		w.PutMsgBool(name, rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return w.putInt(name, rv.Int(), _BlobmsgIntType(rv.Type(), typ, rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return fmt.Errorf("ng: blobmsg: %s overflows int64", name)
+		}
+		return w.putInt(name, int64(u), _BlobmsgIntType(rv.Type(), typ, int64(u)))
+	case reflect.Float32, reflect.Float64:
+		w.PutMsgDouble(name, rv.Float())
+	case reflect.String:
+		w.PutMsgString(name, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 && rv.Kind() == reflect.Slice {
+			w.PutMsgString(name, base64.StdEncoding.EncodeToString(rv.Bytes()))
+			return nil
+		}
+
+		array := w.OpenArray(name)
+		for i := 0; i < rv.Len(); i++ {
+			if err := w.putValue("", rv.Index(i), ""); err != nil {
+				return err
+			}
+		}
+		w.Close(array)
+	case reflect.Struct, reflect.Map:
+		table := w.OpenTable(name)
+		if err := w.addMembers(rv); err != nil {
+			return err
+		}
+		w.Close(table)
+	default:
+		return fmt.Errorf("ng: blobmsg: unsupported type %s", rv.Type())
+	}
+
+	return nil
+}
+
+func (w *BlobWriter) putInt(name string, i int64, typ BlobmsgType) error {
+	switch typ {
+	case BLOBMSG_TYPE_BOOL:
+		w.PutMsgBool(name, i != 0)
+	case BLOBMSG_TYPE_INT8:
+		w.PutMsgInt8(name, int8(i))
+	case BLOBMSG_TYPE_INT16:
+		w.PutMsgInt16(name, int16(i))
+	case BLOBMSG_TYPE_INT32:
+		w.PutMsgInt32(name, int32(i))
+	case BLOBMSG_TYPE_DOUBLE:
+		w.PutMsgDouble(name, float64(i))
+	default:
+		w.PutMsgInt64(name, i)
+	}
+
+	return nil
+}
+
+// a json value given by a json.Marshaler
+func (w *BlobWriter) addJsonBytes(name string, data []byte) error {
+	// wrap it so that AddJsonFromString accepts scalars as well
+	var builder strings.Builder
+	key, _ := json.MarshalToString(name)
+	builder.WriteString("{")
+	builder.WriteString(key)
+	builder.WriteString(":")
+	builder.Write(data)
+	builder.WriteString("}")
+
+	return w.AddJsonFromString(builder.String())
+}
+
+// blobmsg type of an integer kind, typ is the type option of the field tag
+func _BlobmsgIntType(t reflect.Type, typ string, i int64) BlobmsgType {
+	switch typ {
+	case "int8":
+		return BLOBMSG_TYPE_INT8
+	case "int16":
+		return BLOBMSG_TYPE_INT16
+	case "int32":
+		return BLOBMSG_TYPE_INT32
+	case "int64":
+		return BLOBMSG_TYPE_INT64
+	case "bool":
+		return BLOBMSG_TYPE_BOOL
+	case "double":
+		return BLOBMSG_TYPE_DOUBLE
+	}
+
+	switch t.Kind() {
+	case reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32:
+		return BLOBMSG_TYPE_INT32
+	case reflect.Uint32, reflect.Int64, reflect.Uint64:
+		return BLOBMSG_TYPE_INT64
+	default:
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return BLOBMSG_TYPE_INT32
+		}
+		return BLOBMSG_TYPE_INT64
+	}
+}
+
+// blobmsg type a value of t is encoded as, typ is the type option of the field tag
+func _BlobmsgTypeOf(t reflect.Type, typ string) BlobmsgType {
+	if t.Implements(jsonMarshalerType) {
+		return BLOBMSG_TYPE_UNSPEC
+	}
+	if t.Implements(textMarshalerType) {
+		return BLOBMSG_TYPE_STRING
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return _BlobmsgTypeOf(t.Elem(), typ)
+	case reflect.Bool:
+		return BLOBMSG_TYPE_BOOL
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return _BlobmsgIntType(t, typ, 0)
+	case reflect.Float32, reflect.Float64:
+		return BLOBMSG_TYPE_DOUBLE
+	case reflect.String:
+		return BLOBMSG_TYPE_STRING
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return BLOBMSG_TYPE_STRING
+		}
+		return BLOBMSG_TYPE_ARRAY
+	case reflect.Array:
+		return BLOBMSG_TYPE_ARRAY
+	case reflect.Struct, reflect.Map:
+		return BLOBMSG_TYPE_TABLE
+	default:
+		return BLOBMSG_TYPE_UNSPEC
+	}
+}
+
+// * struct fields
+
+type _BlobmsgField struct {
+	name       string
+	index      []int
+	typ        string
+	omitEmpty  bool
+	skipEncode bool
+	skipDecode bool
+}
+
+func _BlobmsgFields(t reflect.Type) []_BlobmsgField {
+	if fields, ok := blobmsgFieldCache.Load(t); ok {
+		return fields.([]_BlobmsgField)
+	}
+
+	fields := make([]_BlobmsgField, 0, t.NumField())
+	_AppendBlobmsgFields(t, nil, &fields)
+
+	blobmsgFieldCache.Store(t, fields)
+	return fields
+}
+
+func _AppendBlobmsgFields(t reflect.Type, index []int, fields *[]_BlobmsgField) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag, fromJson := sf.Tag.Lookup("blobmsg")
+		fromJson = !fromJson
+		if fromJson {
+			tag = sf.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int{}, index...), i)
+
+		// embedded structs without a name are flattened like encoding/json does
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				_AppendBlobmsgFields(ft, fieldIndex, fields)
+				continue
+			}
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		field := _BlobmsgField{name: name, index: fieldIndex}
+		if field.name == "" {
+			field.name = sf.Name
+		}
+
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "omitempty":
+				field.omitEmpty = true
+			case "int8", "int16", "int32", "int64", "bool", "double":
+				field.typ = opt
+			}
+		}
+
+		// the e- and d- options of our json package
+		if fromJson {
+			field.skipEncode = strings.Contains(tag, "e-")
+			field.skipDecode = strings.Contains(tag, "d-")
+		}
+
+		*fields = append(*fields, field)
+	}
+}
+
+// the field at index, false if it is behind a nil embedded pointer
+func _BlobmsgFieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+
+	return rv, true
+}
+
+// same as _BlobmsgFieldByIndex, allocating nil embedded pointers
+func _BlobmsgFieldForSet(rv reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+
+	return rv
+}
+
+// * decoding
+
+func _DecodeBlobmsgTable(attrs []BlobAttr, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return _DecodeBlobmsgTable(attrs, rv.Elem())
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return fmt.Errorf("ng: blobmsg: decode table into %s", rv.Type())
+		}
+
+		m := make(map[string]any, len(attrs))
+		for i := range attrs {
+			v, err := _DecodeBlobmsgAny(&attrs[i])
+			if err != nil {
+				return err
+			}
+			m[attrs[i].Name] = v
+		}
+		rv.Set(reflect.ValueOf(m))
+		return nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("ng: blobmsg: unsupported map key %s", rv.Type().Key())
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(rv.Type(), len(attrs)))
+		}
+
+		for i := range attrs {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := _DecodeBlobmsgValue(&attrs[i], elem); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(attrs[i].Name).Convert(rv.Type().Key()), elem)
+		}
+		return nil
+	case reflect.Struct:
+		fields := _BlobmsgFields(rv.Type())
+
+		for i := range attrs {
+			var field *_BlobmsgField
+			for j := range fields {
+				if fields[j].name == attrs[i].Name {
+					field = &fields[j]
+					break
+				}
+			}
+			if field == nil {
+				for j := range fields {
+					if strings.EqualFold(fields[j].name, attrs[i].Name) {
+						field = &fields[j]
+						break
+					}
+				}
+			}
+			if field == nil || field.skipDecode {
+				continue
+			}
+
+			if err := _DecodeBlobmsgValue(&attrs[i], _BlobmsgFieldForSet(rv, field.index)); err != nil {
+				return fmt.Errorf("%s: %w", attrs[i].Name, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("ng: blobmsg: decode table into %s", rv.Type())
+	}
+}
+
+func _DecodeBlobmsgValue(attr *BlobAttr, rv reflect.Value) error {
+	if attr.Id == blobmsgWireUnspec {
+		if rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface || rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice {
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return nil
+	}
+
+	if rv.Kind() != reflect.Pointer && rv.CanAddr() {
+		if pv := rv.Addr(); pv.Type().Implements(jsonUnmarshalerType) {
+			str, err := _FormatBlobmsgAttrJson(attr)
+			if err != nil {
+				return err
+			}
+			return pv.Interface().(_JsonUnmarshaler).UnmarshalJSON([]byte(str))
+		}
+		if pv := rv.Addr(); pv.Type().Implements(textUnmarshalerType) && attr.Id == blobmsgWireString {
+			return pv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(attr.GetString()))
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return _DecodeBlobmsgValue(attr, rv.Elem())
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return fmt.Errorf("ng: blobmsg: decode into %s", rv.Type())
+		}
+		v, err := _DecodeBlobmsgAny(attr)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(v))
+		}
+		return nil
+	case reflect.Bool:
+		i, ok := _BlobmsgInt(attr)
+		if !ok {
+			return _BlobmsgTypeError(attr, rv)
+		}
+		rv.SetBool(i != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := _BlobmsgInt(attr)
+		if !ok {
+			return _BlobmsgTypeError(attr, rv)
+		}
+		if rv.OverflowInt(i) {
+			return fmt.Errorf("ng: blobmsg: %d overflows %s", i, rv.Type())
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := _BlobmsgInt(attr)
+		if !ok {
+			return _BlobmsgTypeError(attr, rv)
+		}
+		if i < 0 || rv.OverflowUint(uint64(i)) {
+			return fmt.Errorf("ng: blobmsg: %d overflows %s", i, rv.Type())
+		}
+		rv.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		if attr.Id == blobmsgWireDouble {
+			rv.SetFloat(attr.GetDouble())
+			break
+		}
+		i, ok := _BlobmsgInt(attr)
+		if !ok {
+			return _BlobmsgTypeError(attr, rv)
+		}
+		rv.SetFloat(float64(i))
+	case reflect.String:
+		if attr.Id != blobmsgWireString {
+			return _BlobmsgTypeError(attr, rv)
+		}
+		rv.SetString(attr.GetString())
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 && attr.Id == blobmsgWireString {
+			data, err := base64.StdEncoding.DecodeString(attr.GetString())
+			if err != nil {
+				return err
+			}
+			rv.SetBytes(data)
+			break
+		}
+		if attr.Id != blobmsgWireArray {
+			return _BlobmsgTypeError(attr, rv)
+		}
+
+		children, err := attr.Children()
+		if err != nil {
+			return err
+		}
+
+		slice := reflect.MakeSlice(rv.Type(), len(children), len(children))
+		for i := range children {
+			if err := _DecodeBlobmsgValue(&children[i], slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	case reflect.Array:
+		if attr.Id != blobmsgWireArray {
+			return _BlobmsgTypeError(attr, rv)
+		}
+
+		children, err := attr.Children()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < rv.Len() && i < len(children); i++ {
+			if err := _DecodeBlobmsgValue(&children[i], rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map, reflect.Struct:
+		if attr.Id != blobmsgWireTable {
+			return _BlobmsgTypeError(attr, rv)
+		}
+
+		children, err := attr.Children()
+		if err != nil {
+			return err
+		}
+		return _DecodeBlobmsgTable(children, rv)
+	default:
+		return fmt.Errorf("ng: blobmsg: unsupported type %s", rv.Type())
+	}
+
+	return nil
+}
+
+func _DecodeBlobmsgAny(attr *BlobAttr) (any, error) {
+	switch attr.Id {
+	case blobmsgWireArray:
+		children, err := attr.Children()
+		if err != nil {
+			return nil, err
+		}
+
+		array := make([]any, 0, len(children))
+		for i := range children {
+			v, err := _DecodeBlobmsgAny(&children[i])
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		return array, nil
+	case blobmsgWireTable:
+		children, err := attr.Children()
+		if err != nil {
+			return nil, err
+		}
+
+		var m any
+		if err := _DecodeBlobmsgTable(children, reflect.ValueOf(&m).Elem()); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case blobmsgWireString:
+		return attr.GetString(), nil
+	case blobmsgWireInt64:
+		return int64(attr.GetUint64()), nil
+	case blobmsgWireInt32:
+		return int32(attr.GetUint32()), nil
+	case blobmsgWireInt16:
+		return int16(attr.GetUint16()), nil
+	case blobmsgWireInt8:
+		return attr.GetBool(), nil
+	case blobmsgWireDouble:
+		return attr.GetDouble(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// value of an integer attribute, int8 (bool) included
+func _BlobmsgInt(attr *BlobAttr) (int64, bool) {
+	switch attr.Id {
+	case blobmsgWireInt64:
+		return int64(attr.GetUint64()), true
+	case blobmsgWireInt32:
+		return int64(int32(attr.GetUint32())), true
+	case blobmsgWireInt16:
+		return int64(int16(attr.GetUint16())), true
+	case blobmsgWireInt8:
+		return int64(int8(attr.GetUint8())), true
+	default:
+		return 0, false
+	}
+}
+
+func _BlobmsgTypeError(attr *BlobAttr, rv reflect.Value) error {
+	return fmt.Errorf("ng: blobmsg: cannot decode type %d into %s", attr.Type(), rv.Type())
+}
+
+func _FormatBlobmsgAttrJson(attr *BlobAttr) (string, error) {
+	var builder strings.Builder
+	if err := _FormatBlobmsgValue(&builder, attr); err != nil {
+		return "", err
+	}
+
+	return builder.String(), nil
+}
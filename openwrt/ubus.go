@@ -1,20 +1,446 @@
 package openwrt
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SOCK = "/var/run/ubus/ubus.sock"
+	// invoke timeout in ms when the context has no deadline, same as `ubus call`
+	DEFAULT_INVOKE_TIMEOUT = 30000
+)
+
+type BlobmsgType int
+
+const (
+	BLOBMSG_TYPE_UNSPEC BlobmsgType = iota
+	BLOBMSG_TYPE_ARRAY
+	BLOBMSG_TYPE_TABLE
+	BLOBMSG_TYPE_STRING
+	BLOBMSG_TYPE_INT64
+	BLOBMSG_TYPE_INT32
+	BLOBMSG_TYPE_INT16
+	BLOBMSG_TYPE_INT8
+	BLOBMSG_TYPE_BOOL
+	BLOBMSG_TYPE_DOUBLE
+)
+
+// enum ubus_msg_status, an UbusStatus is the error of a failed request and may
+// be returned by handlers
+type UbusStatus int
+
+const (
+	UBUS_STATUS_OK UbusStatus = iota
+	UBUS_STATUS_INVALID_COMMAND
+	UBUS_STATUS_INVALID_ARGUMENT
+	UBUS_STATUS_METHOD_NOT_FOUND
+	UBUS_STATUS_NOT_FOUND
+	UBUS_STATUS_NO_DATA
+	UBUS_STATUS_PERMISSION_DENIED
+	UBUS_STATUS_TIMEOUT
+	UBUS_STATUS_NOT_SUPPORTED
+	UBUS_STATUS_UNKNOWN_ERROR
+	UBUS_STATUS_CONNECTION_FAILED
+	UBUS_STATUS_NO_MEMORY
+	UBUS_STATUS_PARSE_ERROR
+	UBUS_STATUS_SYSTEM_ERROR
+)
+
+var ubusStatusStrings = []string{
+	"Success",
+	"Invalid command",
+	"Invalid argument",
+	"Method not found",
+	"Not found",
+	"No response",
+	"Permission denied",
+	"Request timed out",
+	"Operation not supported",
+	"Unknown error",
+	"Connection failed",
+	"Out of memory",
+	"Parsing message data failed",
+	"System error",
+}
+
+// same as ubus_strerror
+func (status UbusStatus) String() string {
+	if status < 0 || int(status) >= len(ubusStatusStrings) {
+		return ubusStatusStrings[UBUS_STATUS_UNKNOWN_ERROR]
+	}
+
+	return ubusStatusStrings[status]
+}
+
+func (status UbusStatus) Error() string {
+	return fmt.Sprintf("%d: %s", int(status), status.String())
+}
+
+// status to reply for an error returned by a handler: the UbusStatus it wraps,
+// or one matching a well known error
+func UbusStatusOf(err error) UbusStatus {
+	var status UbusStatus
+
+	switch {
+	case err == nil:
+		return UBUS_STATUS_OK
+	case errors.As(err, &status):
+		return status
+	case errors.Is(err, context.DeadlineExceeded):
+		return UBUS_STATUS_TIMEOUT
+	case errors.Is(err, os.ErrNotExist):
+		return UBUS_STATUS_NOT_FOUND
+	case errors.Is(err, os.ErrPermission):
+		return UBUS_STATUS_PERMISSION_DENIED
+	default:
+		return UBUS_STATUS_UNKNOWN_ERROR
+	}
+}
+
+// an error carrying the status to reply, Message is for the log only since
+// ubus has no way to send it to the caller
+type UbusStatusError struct {
+	Status  UbusStatus
+	Message string
+}
+
+func NewUbusStatusError(status UbusStatus, format string, args ...any) *UbusStatusError {
+	return &UbusStatusError{status, fmt.Sprintf(format, args...)}
+}
+
+func (e *UbusStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status.Error(), e.Message)
+}
+
+func (e *UbusStatusError) Unwrap() error {
+	return e.Status
+}
+
+// callback, the error of a method handler is replied as its UbusStatusOf
+type UbusHandler func(obj string, method string, req *UbusRequestData, msg string) error
+type UbusDataHandler func(msg string) error
+type UbusEventHandler func(event string, msg string)
+
+// callback of a subscriber, typ is the type passed to Notify. the error is the
+// status of the notification, only seen by publishers waiting for a reply
+type UbusNotifyHandler func(typ string, msg string) error
+
+// callback of a subscriber, id is the object that went away
+type UbusRemoveHandler func(id uint32)
+
+// ubus object related
+type UbusObject struct {
+	Name    string
+	Methods []UbusMethod
+	// wrap the handlers of all methods, see Use
+	Middlewares []UbusMiddleware
+
+	// set once the object is added, for Notify
+	ctx *UbusContext
+}
+
+func (obj *UbusObject) AddMethod(name string, handler UbusHandler, fields ...UbusMethodField) {
+	if obj.Methods == nil {
+		obj.Methods = make([]UbusMethod, 0)
+	}
+
+	obj.Methods = append(obj.Methods, UbusMethod{Name: name, Handler: handler, Fields: fields})
+}
+
+// restrict who may call the method, see UbusAclMiddleware. nil lets anyone call it
+func (obj *UbusObject) SetMethodAcl(name string, acl *UbusAcl) error {
+	for i := range obj.Methods {
+		if obj.Methods[i].Name == name {
+			obj.Methods[i].Acl = acl
+			return nil
+		}
+	}
+
+	return errors.New("ng: ubus method not found")
+}
+
+// notify the subscribers of the object, see UbusContext.Notify
+func (obj *UbusObject) Notify(typ string, msg any) error {
+	if obj.ctx == nil {
+		return errors.New("ng: ubus object not added")
+	}
+
+	return obj.ctx.Notify(obj.Name, typ, msg)
+}
+
+type UbusMethod struct {
+	Name    string
+	Handler UbusHandler
+	Fields  []UbusMethodField
+	// callers allowed, nil for anyone. only enforced by UbusAclMiddleware
+	Acl *UbusAcl
+}
+
+/*
+ACL users and groups allowed to call a method. ubusd resolves them from the
+uid and gid of the caller with its acl files, see UbusRequestData.User.
+
+a caller is allowed when its user or one of the groups matches, "*" matches
+any caller known to the ACL.
+*/
+type UbusAcl struct {
+	Users  []string
+	Groups []string
+}
+
+func (acl *UbusAcl) Allows(user string, group string) bool {
+	for _, u := range acl.Users {
+		if user != "" && (u == "*" || u == user) {
+			return true
+		}
+	}
+	for _, g := range acl.Groups {
+		if group != "" && (g == "*" || g == group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wrap handler to reply UBUS_STATUS_PERMISSION_DENIED to callers the Acl of
+// the method does not allow
+func UbusAclMiddleware(handler UbusHandler) UbusHandler {
+	return func(obj string, method string, req *UbusRequestData, msg string) error {
+		if req.acl != nil && !req.acl.Allows(req.user, req.group) {
+			return NewUbusStatusError(UBUS_STATUS_PERMISSION_DENIED, "user %q group %q not allowed to call %s.%s", req.user, req.group, obj, method)
+		}
+
+		return handler(obj, method, req, msg)
+	}
+}
+
+type UbusMethodField struct {
+	Name string
+	Type BlobmsgType
+	// requests without the field are answered with UBUS_STATUS_INVALID_ARGUMENT
+	Required bool
+}
+
+// check the policy and run the handler, the status to reply
+func (method *UbusMethod) call(obj string, req *UbusRequestData, msg string) (status UbusStatus) {
+	if t := _TracerOf(req.ctx); t != nil {
+		start := time.Now()
+		defer func() {
+			t.record(&UbusTraceRecord{
+				Time:    start,
+				Kind:    UBUS_TRACE_HANDLE,
+				Object:  obj,
+				Id:      req.object,
+				Method:  method.Name,
+				Peer:    req.peer,
+				Elapsed: time.Since(start),
+				Status:  status,
+			}, _TraceArgs(req, msg))
+		}()
+	}
+
+	if status := _CheckUbusPolicy(method.Fields, req.data); status != UBUS_STATUS_OK {
+		return status
+	}
+
+	req.obj, req.method, req.acl = obj, method.Name, method.Acl
+
+	return UbusStatusOf(method.Handler(obj, method.Name, req, msg))
+}
+
+// same as blobmsg_parse, a required field is missing when there is no
+// attribute of its name and type
+func _CheckUbusPolicy(fields []UbusMethodField, data []byte) UbusStatus {
+	required := false
+	for _, field := range fields {
+		required = required || field.Required
+	}
+	if !required {
+		return UBUS_STATUS_OK
+	}
+
+	attrs, err := ParseBlobAttrs(data)
+	if err != nil {
+		return UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	for _, field := range fields {
+		if !field.Required {
+			continue
+		}
+
+		found := false
+		for i := range attrs {
+			if attrs[i].Name == field.Name && (field.Type == BLOBMSG_TYPE_UNSPEC || attrs[i].Id == field.Type.wireType()) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return UBUS_STATUS_INVALID_ARGUMENT
+		}
+	}
+
+	return UBUS_STATUS_OK
+}
+
+// consumer of the notifications of other objects, see UbusContext.RegisterSubscriber
+type UbusSubscriber struct {
+	// called for each notification of the objects subscribed to
+	Handler UbusNotifyHandler
+	// called when ubusd drops a subscription since the object was removed
+	RemoveHandler UbusRemoveHandler
+}
+
+// an object found by UbusContext.Lookup
+type UbusObjectData struct {
+	Id     uint32
+	TypeId uint32
+	Path   string
+	// the arguments of each method, as listed by `ubus -v list`
+	Signature map[string][]UbusMethodField
+}
+
+// parse the UBUS_ATTR_SIGNATURE of an object, a table of arguments for each
+// method. int8 arguments are reported as BLOBMSG_TYPE_BOOL like `ubus -v list`
+// does, since that is what policies with bool fields register
+func _ParseUbusSignature(data []byte) (map[string][]UbusMethodField, error) {
+	methods, err := ParseBlobAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := make(map[string][]UbusMethodField, len(methods))
+	for i := range methods {
+		args, err := methods[i].Children()
+		if err != nil {
+			return nil, err
+		}
+
+		fields := make([]UbusMethodField, 0, len(args))
+		for j := range args {
+			typ := _BlobmsgTypeOfWire(int(args[j].GetUint32()))
+			if typ == BLOBMSG_TYPE_INT8 {
+				typ = BLOBMSG_TYPE_BOOL
+			}
+
+			fields = append(fields, UbusMethodField{Name: args[j].Name, Type: typ})
+		}
+
+		signature[methods[i].Name] = fields
+	}
+
+	return signature, nil
+}
+
+// decode the arguments of the request into v, see BlobmsgUnmarshal
+func (req *UbusRequestData) Decode(v any) error {
+	return BlobmsgUnmarshal(req.data, v)
+}
+
+// same as ubus_send_reply. may be called more than once, the caller receives a
+// data message per call, see UbusStream
+func (req *UbusRequestData) Reply(msg any) error {
+	return req.ctx.SendReply(req, msg)
+}
+
+// client id of the caller
+func (req *UbusRequestData) Peer() uint32 {
+	return req.peer
+}
+
+// id of the object called
+func (req *UbusRequestData) Object() uint32 {
+	return req.object
+}
+
+// path of the object called
+func (req *UbusRequestData) ObjectName() string {
+	return req.obj
+}
+
+func (req *UbusRequestData) Method() string {
+	return req.method
+}
+
+// ACL user of the caller, empty when ubusd runs without acl files
+func (req *UbusRequestData) User() string {
+	return req.user
+}
+
+// ACL group of the caller, empty when ubusd runs without acl files
+func (req *UbusRequestData) Group() string {
+	return req.group
+}
+
+// context of the connection the request came in on
+func (req *UbusRequestData) goContext() context.Context {
+	if req.ctx == nil || req.ctx.goCtx == nil {
+		return context.Background()
+	}
+
+	return req.ctx.goCtx
+}
+
 type UbusClient struct {
 	Context *UbusContext
 	Started bool
 
-	Objects   map[string]UbusObject
-	Listeners map[string]UbusEventHandler
+	Objects     map[string]UbusObject
+	Listeners   map[string]UbusEventHandler
+	Subscribers map[string]*UbusSubscriber
+	// wrap the handlers of all objects, see Use
+	Middlewares []UbusMiddleware
+
+	// guards the fields above
+	mutex sync.Mutex
 }
 
 func NewUbusClient(reconnect bool) (*UbusClient, error) {
-	ctx, err := NewUbusContext(reconnect)
+	return NewUbusClientWithConfig(context.Background(), &UbusConfig{Reconnect: reconnect})
+}
+
+func NewUbusClientWithContext(goCtx context.Context, reconnect bool) (*UbusClient, error) {
+	return NewUbusClientWithConfig(goCtx, &UbusConfig{Reconnect: reconnect})
+}
+
+// a client safe for concurrent use by any goroutine, see NewUbusLoopContext.
+// Start adds the objects and listeners but the uloop is already running
+func NewUbusLoopClient(goCtx context.Context, reconnect bool) (*UbusClient, error) {
+	return NewUbusClientWithConfig(goCtx, &UbusConfig{Reconnect: reconnect, Loop: true})
+}
+
+// a client on a connection with the given settings, a nil config for the
+// defaults. the subscriptions of the client are renewed after a reconnect
+func NewUbusClientWithConfig(goCtx context.Context, config *UbusConfig) (*UbusClient, error) {
+	client := &UbusClient{}
+
+	resolved := UbusConfig{}
+	if config != nil {
+		resolved = *config
+	}
+	onReconnect := resolved.OnReconnect
+	resolved.OnReconnect = func() {
+		client.resubscribe()
+		if onReconnect != nil {
+			onReconnect()
+		}
+	}
+
+	ctx, err := NewUbusContextWithConfig(goCtx, &resolved)
 	if err != nil {
 		return nil, err
 	}
+	client.Context = ctx
 
-	return &UbusClient{ctx, false, nil, nil}, nil
+	return client, nil
 }
 
 func (client *UbusClient) Free() {
@@ -22,13 +448,20 @@ func (client *UbusClient) Free() {
 }
 
 func (client *UbusClient) AddObject(obj *UbusObject) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
 	if client.Objects == nil {
 		client.Objects = make(map[string]UbusObject)
 	}
+	obj.ctx = client.Context
 	client.Objects[obj.Name] = *obj
 }
 
 func (client *UbusClient) RegisterEvent(event string, cb UbusEventHandler) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
 	if client.Listeners == nil {
 		client.Listeners = make(map[string]UbusEventHandler)
 	}
@@ -36,6 +469,9 @@ func (client *UbusClient) RegisterEvent(event string, cb UbusEventHandler) {
 }
 
 func (client *UbusClient) RemoveObject(name string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
 	delete(client.Objects, name)
 
 	if client.Started {
@@ -46,6 +482,9 @@ func (client *UbusClient) RemoveObject(name string) error {
 }
 
 func (client *UbusClient) UnregisterEvent(event string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
 	delete(client.Listeners, event)
 
 	if client.Started {
@@ -55,10 +494,84 @@ func (client *UbusClient) UnregisterEvent(event string) error {
 	return nil
 }
 
+// subscribe s to the object at path, done by Start when the client is not started.
+// the object must exist by then
+func (client *UbusClient) Subscribe(path string, s *UbusSubscriber) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.Subscribers == nil {
+		client.Subscribers = make(map[string]*UbusSubscriber)
+	}
+	client.Subscribers[path] = s
+
+	if client.Started {
+		return client.subscribe(path, s)
+	}
+
+	return nil
+}
+
+func (client *UbusClient) subscribe(path string, s *UbusSubscriber) error {
+	if err := client.Context.RegisterSubscriber(s); err != nil {
+		return err
+	}
+
+	id, err := client.Context.LookupId(path)
+	if err != nil {
+		return err
+	}
+
+	return client.Context.Subscribe(s, id)
+}
+
+// subscribe again by path, the ids are new after reconnecting. objects that are
+// not back yet are skipped
+func (client *UbusClient) resubscribe() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if !client.Started {
+		return
+	}
+
+	for path, s := range client.Subscribers {
+		client.subscribe(path, s)
+	}
+}
+
+func (client *UbusClient) Unsubscribe(path string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	s, ok := client.Subscribers[path]
+	if !ok {
+		return nil
+	}
+	delete(client.Subscribers, path)
+
+	if client.Started {
+		id, err := client.Context.LookupId(path)
+		if err != nil {
+			return err
+		}
+
+		return client.Context.Unsubscribe(s, id)
+	}
+
+	return nil
+}
+
 func (client *UbusClient) Start() (err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
 	if len(client.Objects) > 0 {
 		for name := range client.Objects {
 			obj := client.Objects[name]
+			if len(client.Middlewares) > 0 {
+				obj.Middlewares = append(append([]UbusMiddleware{}, client.Middlewares...), obj.Middlewares...)
+			}
 			if err = client.Context.AddObject(&obj); err != nil {
 				return err
 			}
@@ -74,10 +587,20 @@ func (client *UbusClient) Start() (err error) {
 		}
 	}
 
-	if len(client.Objects) > 0 || len(client.Listeners) > 0 {
+	if len(client.Subscribers) > 0 {
+		for path, s := range client.Subscribers {
+			if err = client.subscribe(path, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(client.Objects) > 0 || len(client.Listeners) > 0 || len(client.Subscribers) > 0 {
 		client.Context.AddULoop()
 	}
 
+	client.Started = true
+
 	return nil
 }
 
@@ -94,6 +617,19 @@ func (client *UbusClient) Invoke(obj string, method string, param any, timeout i
 	return client.Context.Invoke(id, method, param, timeout, cb)
 }
 
+func (client *UbusClient) InvokeContext(goCtx context.Context, obj string, method string, param any, cb UbusDataHandler) error {
+	id, err := client.Context.LookupIdContext(goCtx, obj)
+	if err != nil {
+		return err
+	}
+
+	return client.Context.InvokeContext(goCtx, id, method, param, cb)
+}
+
 func (client *UbusClient) SendEvent(id string, msg any) error {
 	return client.Context.SendEvent(id, msg)
 }
+
+func (client *UbusClient) SendEventContext(goCtx context.Context, id string, msg any) error {
+	return client.Context.SendEventContext(goCtx, id, msg)
+}
@@ -0,0 +1,106 @@
+package openwrt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/json"
+)
+
+// a call answered with a status other than UBUS_STATUS_OK
+type UbusError struct {
+	Object string
+	Method string
+	Status UbusStatus
+}
+
+func (e *UbusError) Error() string {
+	return fmt.Sprintf("ng: ubus call %s %s: %s", e.Object, e.Method, e.Status.Error())
+}
+
+func (e *UbusError) Unwrap() error {
+	return e.Status
+}
+
+func _WrapUbusError(obj string, method string, err error) error {
+	var status UbusStatus
+	if errors.As(err, &status) {
+		return &UbusError{Object: obj, Method: method, Status: status}
+	}
+
+	return err
+}
+
+// call method of obj and decode the reply into T, the zero T if there is none
+func Call[T any](client *UbusClient, obj string, method string, params any) (T, error) {
+	goCtx, cancel := context.WithTimeout(context.Background(), DEFAULT_INVOKE_TIMEOUT*time.Millisecond)
+	defer cancel()
+
+	return CallContext[T](goCtx, client, obj, method, params)
+}
+
+func CallContext[T any](goCtx context.Context, client *UbusClient, obj string, method string, params any) (T, error) {
+	var result T
+
+	id, err := client.Context.LookupIdContext(goCtx, obj)
+	if err != nil {
+		return result, _WrapUbusError(obj, method, err)
+	}
+
+	err = client.Context.InvokeContext(goCtx, id, method, params, func(msg string) error {
+		return json.UnmarshalFromString(msg, &result)
+	})
+	if err != nil {
+		return result, _WrapUbusError(obj, method, err)
+	}
+
+	return result, nil
+}
+
+/*
+Call method of every object matching pattern, e.g. network.interface.*, and
+collect the decoded replies in the order of the objects. objects that send no
+reply are skipped.
+
+all objects are called even if some fail, the error is the one of the first
+failed call.
+*/
+func CallAll[T any](client *UbusClient, pattern string, method string, params any) ([]T, error) {
+	goCtx, cancel := context.WithTimeout(context.Background(), DEFAULT_INVOKE_TIMEOUT*time.Millisecond)
+	defer cancel()
+
+	return CallAllContext[T](goCtx, client, pattern, method, params)
+}
+
+func CallAllContext[T any](goCtx context.Context, client *UbusClient, pattern string, method string, params any) ([]T, error) {
+	objects, err := client.Context.LookupContext(goCtx, pattern)
+	if err != nil {
+		return nil, _WrapUbusError(pattern, method, err)
+	}
+	if len(objects) == 0 {
+		return nil, &UbusError{Object: pattern, Method: method, Status: UBUS_STATUS_NOT_FOUND}
+	}
+
+	results := make([]T, 0, len(objects))
+	var firstErr error
+
+	for _, object := range objects {
+		err := client.Context.InvokeContext(goCtx, object.Id, method, params, func(msg string) error {
+			var result T
+			if err := json.UnmarshalFromString(msg, &result); err != nil {
+				return err
+			}
+
+			results = append(results, result)
+			return nil
+		})
+
+		if err != nil && firstErr == nil {
+			firstErr = _WrapUbusError(object.Path, method, err)
+		}
+	}
+
+	return results, firstErr
+}
@@ -1,3 +1,5 @@
+//go:build cgo && !ubus_native
+
 package openwrt
 
 /*
@@ -40,6 +42,7 @@ static struct ubus_method init_ubus_method(char *method_name, struct blobmsg_pol
 }
 
 extern void ubus_data_handler_stub(struct ubus_request *req, int type, struct blob_attr *msg);
+extern void ubus_fd_handler_stub(struct ubus_request *req, int fd);
 
 extern void ubus_event_handler_stub(struct ubus_context *ctx, struct ubus_event_handler *ev, char *type, struct blob_attr *msg);
 
@@ -52,35 +55,43 @@ static void bind_ubus_event_handler(struct ubus_event_handler *ue)
 {
 	ue->cb = ubus_event_handler_wrapper;
 }
+
+extern void ubus_lookup_handler_stub(struct ubus_context *ctx, struct ubus_object_data *obj, void *priv);
+
+static int ubus_lookup_objects(struct ubus_context *ctx, const char *path, uintptr_t handle)
+{
+	return ubus_lookup(ctx, path, ubus_lookup_handler_stub, (void *)handle);
+}
+
+extern int ubus_subscriber_handler_stub(struct ubus_context *ctx, struct ubus_object *obj, struct ubus_request_data *req, char *method, struct blob_attr *msg);
+extern void ubus_subscriber_remove_stub(struct ubus_context *ctx, struct ubus_subscriber *s, uint32_t id);
+
+static int ubus_subscriber_handler_wrapper(struct ubus_context *ctx, struct ubus_object *obj, struct ubus_request_data *req, const char *method, struct blob_attr *msg)
+{
+	return ubus_subscriber_handler_stub(ctx, obj, req, (char *)method, msg);
+}
+
+static void bind_ubus_subscriber(struct ubus_subscriber *s)
+{
+	s->cb = ubus_subscriber_handler_wrapper;
+	s->remove_cb = ubus_subscriber_remove_stub;
+}
 */
 import "C"
 import (
-	"fmt"
-	"path"
+	"context"
+	"errors"
+	"os"
+	"runtime/cgo"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/hzwesoft-github/underscore/lang"
 )
 
-const DEFAULT_SOCK = "/var/run/ubus/ubus.sock"
-
-type BlobmsgType int
-
-const (
-	BLOBMSG_TYPE_UNSPEC BlobmsgType = iota
-	BLOBMSG_TYPE_ARRAY
-	BLOBMSG_TYPE_TABLE
-	BLOBMSG_TYPE_STRING
-	BLOBMSG_TYPE_INT64
-	BLOBMSG_TYPE_INT32
-	BLOBMSG_TYPE_INT16
-	BLOBMSG_TYPE_INT8
-	BLOBMSG_TYPE_BOOL
-	BLOBMSG_TYPE_DOUBLE
-)
-
 func (typ BlobmsgType) toEnum() C.enum_blobmsg_type {
 	switch typ {
 	case BLOBMSG_TYPE_UNSPEC:
@@ -109,49 +120,57 @@ func (typ BlobmsgType) toEnum() C.enum_blobmsg_type {
 }
 
 var (
-	ubusHandlerMap        lang.DMap[string, string, UbusHandler] = lang.NewDMap[string, string, UbusHandler]()
-	ubusDataHandlerMap    map[int32]UbusDataHandler              = make(map[int32]UbusDataHandler)
-	ubusDataHandlerErrors map[int32]error                        = make(map[int32]error)
-	ubusEventHandlerMap   map[string]UbusEventHandler            = make(map[string]UbusEventHandler)
-	mutex                 sync.Mutex
-)
+	// serializes calls into libubus, a channel so that waiting can be canceled
+	ubusLock chan struct{} = make(chan struct{}, 1)
 
-// encapsulate ubus_context
-type UbusContext struct {
-	ptr *C.struct_ubus_context
+	ubusContextMap   map[*C.struct_ubus_context]*UbusContext = make(map[*C.struct_ubus_context]*UbusContext)
+	ubusContextMutex sync.RWMutex
+)
 
-	ubusObjPtrMap map[string]_UbusObjectPtr
-	listeners     map[string]_UbusEventListener
+func lockUbus(goCtx context.Context) error {
+	select {
+	case ubusLock <- struct{}{}:
+		return nil
+	case <-goCtx.Done():
+		return goCtx.Err()
+	}
 }
 
-// callback
-type UbusHandler func(obj string, method string, req *UbusRequestData, msg string)
-type UbusDataHandler func(msg string) error
-type UbusEventHandler func(event string, msg string)
-
-// ubus object related
-type UbusObject struct {
-	Name    string
-	Methods []UbusMethod
+func unlockUbus() {
+	<-ubusLock
 }
 
-func (obj *UbusObject) AddMethod(name string, handler UbusHandler, fields ...UbusMethodField) {
-	if obj.Methods == nil {
-		obj.Methods = make([]UbusMethod, 0)
-	}
+func lookupUbusContext(ptr *C.struct_ubus_context) *UbusContext {
+	ubusContextMutex.RLock()
+	defer ubusContextMutex.RUnlock()
 
-	obj.Methods = append(obj.Methods, UbusMethod{name, handler, fields})
+	return ubusContextMap[ptr]
 }
 
-type UbusMethod struct {
-	Name    string
-	Handler UbusHandler
-	Fields  []UbusMethodField
-}
+// encapsulate ubus_context
+type UbusContext struct {
+	ptr    *C.struct_ubus_context
+	goCtx  context.Context
+	config UbusConfig
+	// calls are made on the uloop thread, see NewUbusLoopContext
+	loop bool
 
-type UbusMethodField struct {
-	Name string
-	Type BlobmsgType
+	ubusObjPtrMap map[string]_UbusObjectPtr
+	listeners     map[string]_UbusEventListener
+	subscribers   map[*UbusSubscriber]*C.struct_ubus_subscriber
+
+	// handlers looked up by the callbacks of libubus, guarded by mutex
+	mutex        sync.RWMutex
+	methods      lang.DMap[string, string, UbusMethod]
+	events       map[*C.struct_ubus_event_handler]UbusEventHandler
+	notify       map[*C.struct_ubus_object]*UbusSubscriber
+	dataHandlers map[int32]UbusDataHandler
+	dataErrors   map[int32]error
+	fileHandlers map[int32]func(f *os.File)
+
+	fanout _UbusEventFanout
+	// see SetTracer
+	tracer atomic.Pointer[UbusTracer]
 }
 
 // pointers to be free
@@ -220,52 +239,166 @@ func (l *_UbusEventListener) free() {
 
 //export connection_lost_callback
 func connection_lost_callback(ctx *C.struct_ubus_context) {
-	cpath := C.CString(DEFAULT_SOCK)
-	defer C.free(unsafe.Pointer(cpath))
+	c := lookupUbusContext(ctx)
+	if c == nil {
+		return
+	}
 
-	for {
-		if int32(C.ubus_reconnect(ctx, cpath)) == 0 {
-			break
-		}
+	if c.config.OnDisconnect != nil {
+		c.config.OnDisconnect()
+	}
+
+	cpath := C.CString(c.config.Sock)
+	defer C.free(unsafe.Pointer(cpath))
 
-		<-time.After(time.Second)
+	// blocks the uloop, as libubus can't serve anything until reconnected.
+	// stops once the context of the connection is done
+	connected := c.config.retry(c.goCtx, func() bool {
+		return int32(C.ubus_reconnect(ctx, cpath)) == 0
+	})
+	if !connected {
+		return
 	}
 
 	C.ubus_add_uloop(ctx)
+
+	// libubus adds the objects again, the patterns of the listeners are lost
+	for pattern, listener := range c.listeners {
+		cpattern := C.CString(pattern)
+		C.ubus_register_event_handler(ctx, listener.ptr, cpattern)
+		C.free(unsafe.Pointer(cpattern))
+	}
+
+	if c.config.OnReconnect != nil {
+		c.config.OnReconnect()
+	}
 }
 
 // new connection to ubusd
-func NewUbusContext(reconnect bool) (context *UbusContext, err error) {
-	cpath := C.CString(DEFAULT_SOCK)
+func NewUbusContext(reconnect bool) (*UbusContext, error) {
+	return NewUbusContextWithContext(context.Background(), reconnect)
+}
+
+// new connection to ubusd, reconnecting stops when goCtx is done
+func NewUbusContextWithContext(goCtx context.Context, reconnect bool) (*UbusContext, error) {
+	return NewUbusContextWithConfig(goCtx, &UbusConfig{Reconnect: reconnect})
+}
+
+/*
+New connection driven by a uloop running on its own locked OS thread, the
+context is safe for concurrent use by any goroutine.
+
+libubus is only ever called from that thread, calls from other goroutines are
+queued to it and wait for their turn. handlers run on the thread as well and
+may call the context directly. the application must not call UloopRun. signal
+handling is left to go, see uloopStart.
+*/
+func NewUbusLoopContext(goCtx context.Context, reconnect bool) (*UbusContext, error) {
+	return NewUbusContextWithConfig(goCtx, &UbusConfig{Reconnect: reconnect, Loop: true})
+}
+
+// new connection to ubusd, a nil config for the defaults
+func NewUbusContextWithConfig(goCtx context.Context, config *UbusConfig) (*UbusContext, error) {
+	resolved := _ResolveUbusConfig(config)
+	if !resolved.Loop {
+		return newUbusContext(goCtx, resolved)
+	}
+
+	if err := uloopStart(); err != nil {
+		return nil, err
+	}
+
+	return _UloopCall(context.Background(), func() (*UbusContext, error) {
+		ctx, err := newUbusContext(goCtx, resolved)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.loop = true
+		if err := ctx.AddULoop(); err != nil {
+			ctx.Free()
+			return nil, err
+		}
+
+		return ctx, nil
+	})
+}
+
+func newUbusContext(goCtx context.Context, config UbusConfig) (*UbusContext, error) {
+	if err := goCtx.Err(); err != nil {
+		return nil, err
+	}
+
+	cpath := C.CString(config.Sock)
 	defer C.free(unsafe.Pointer(cpath))
 
-	var ctx *C.struct_ubus_context
-	if ctx, err = C.ubus_connect(cpath); err != nil {
+	ctx, err := C.ubus_connect(cpath)
+	if err != nil {
 		return nil, err
 	}
 
-	if reconnect {
+	if config.Reconnect {
 		C.ubus_connection_lost(ctx)
 	}
 
-	return &UbusContext{
+	ubusCtx := &UbusContext{
 		ptr:           ctx,
+		goCtx:         goCtx,
+		config:        config,
 		ubusObjPtrMap: make(map[string]_UbusObjectPtr),
 		listeners:     make(map[string]_UbusEventListener),
-	}, nil
+		subscribers:   make(map[*UbusSubscriber]*C.struct_ubus_subscriber),
+		methods:       lang.NewDMap[string, string, UbusMethod](),
+		events:        make(map[*C.struct_ubus_event_handler]UbusEventHandler),
+		notify:        make(map[*C.struct_ubus_object]*UbusSubscriber),
+		dataHandlers:  make(map[int32]UbusDataHandler),
+		dataErrors:    make(map[int32]error),
+		fileHandlers:  make(map[int32]func(f *os.File)),
+	}
+
+	ubusContextMutex.Lock()
+	ubusContextMap[ctx] = ubusCtx
+	ubusContextMutex.Unlock()
+
+	return ubusCtx, nil
+}
+
+// whether the call has to be queued to the uloop thread
+func (ctx *UbusContext) remote() bool {
+	return ctx.loop && !uloopOnThread()
+}
+
+func (ctx *UbusContext) post(goCtx context.Context, fn func() error) error {
+	_, err := _UloopCall(goCtx, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
 }
 
 func (ctx *UbusContext) AddULoop() error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), ctx.AddULoop)
+	}
+
 	_, err := C.ubus_add_uloop(ctx.ptr)
 	return err
 }
 
 func (ctx *UbusContext) Free() error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), ctx.Free)
+	}
+
+	ubusContextMutex.Lock()
+	delete(ubusContextMap, ctx.ptr)
+	ubusContextMutex.Unlock()
+
 	if _, err := C.ubus_free(ctx.ptr); err != nil {
 		return err
 	}
 
 	for _, ptr := range ctx.ubusObjPtrMap {
+		ptr.ready = false
 		ptr.free()
 	}
 
@@ -273,37 +406,184 @@ func (ctx *UbusContext) Free() error {
 		l.free()
 	}
 
+	for _, ptr := range ctx.subscribers {
+		C.free(unsafe.Pointer(ptr))
+	}
+
 	return nil
 }
 
 //export ubus_handler_stub
 func ubus_handler_stub(ctx *C.struct_ubus_context, obj *C.struct_ubus_object,
 	req *C.struct_ubus_request_data, method *C.char, msg *C.struct_blob_attr) C.int {
+	c := lookupUbusContext(ctx)
+	if c == nil {
+		return C.int(UBUS_STATUS_NOT_FOUND)
+	}
+
 	objName := C.GoString(obj.name)
 	methodName := C.GoString(method)
 
-	if !lang.HasDMapKey(ubusHandlerMap, objName, methodName) {
-		return C.int(3)
+	c.mutex.RLock()
+	found := lang.HasDMapKey(c.methods, objName, methodName)
+	var m UbusMethod
+	if found {
+		m = c.methods[objName][methodName]
+	}
+	c.mutex.RUnlock()
+
+	if !found {
+		return C.int(UBUS_STATUS_METHOD_NOT_FOUND)
 	}
 
 	str := C.blobmsg_format_json_indent(msg, C.bool(true), C.int(0))
 	defer C.free(unsafe.Pointer(str))
 
 	r := &UbusRequestData{
-		ptr: req,
+		ptr:    req,
+		ctx:    c,
+		data:   C.GoBytes(C.blob_data(msg), C.int(C.blob_len(msg))),
+		object: uint32(req.object),
+		peer:   uint32(req.peer),
+	}
+	if req.acl.user != nil {
+		r.user = C.GoString(req.acl.user)
+	}
+	if req.acl.group != nil {
+		r.group = C.GoString(req.acl.group)
 	}
-	ubusHandlerMap[objName][methodName](objName, methodName, r, C.GoString(str))
 
-	return C.int(0)
+	return C.int(m.call(objName, r, C.GoString(str)))
 }
 
 // encapsulate ubus_request_data
 type UbusRequestData struct {
-	ptr *C.struct_ubus_request_data
+	ptr  *C.struct_ubus_request_data
+	ctx  *UbusContext
+	data []byte
+
+	// caller and method, see the accessors in ubus.go
+	object uint32
+	peer   uint32
+	obj    string
+	method string
+	user   string
+	group  string
+	acl    *UbusAcl
+}
+
+// a request answered after its handler returned, see UbusRequestData.Defer
+type UbusDeferredRequest struct {
+	ctx   *UbusContext
+	ptr   *C.struct_ubus_request_data
+	mutex sync.Mutex
+	done  bool
+}
+
+// encapsulate ubus_request_get_caller_fd, the file sent along with the call or
+// nil. the handler owns it from then on, it's closed once the handler returns
+// otherwise
+func (req *UbusRequestData) CallerFile() *os.File {
+	if req.ptr == nil {
+		return nil
+	}
+
+	fd := C.ubus_request_get_caller_fd(req.ptr)
+	if fd < 0 {
+		return nil
+	}
+	// libubus closes req_fd after the handler, it's ours now
+	req.ptr.req_fd = -1
+
+	return os.NewFile(uintptr(fd), "ubus")
+}
+
+// encapsulate ubus_request_set_fd, f is sent along with the status of the
+// request. call before Defer for a deferred request. a copy is sent, the handler
+// keeps f
+func (req *UbusRequestData) SetReplyFile(f *os.File) error {
+	if req.ptr == nil || f == nil {
+		return nil
+	}
+
+	// libubus closes the fd once sent, it gets a copy
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+	if req.ptr.fd >= 0 {
+		syscall.Close(int(req.ptr.fd))
+	}
+	C.ubus_request_set_fd(req.ctx.ptr, req.ptr, C.int(fd))
+	return nil
+}
+
+// encapsulate ubus_defer_request. must be called by the handler, which may then
+// return and leave the reply to another goroutine. the request stays open until
+// Complete is called
+func (req *UbusRequestData) Defer() *UbusDeferredRequest {
+	ptr := (*C.struct_ubus_request_data)(C.calloc(1, C.sizeof_struct_ubus_request_data))
+	C.ubus_defer_request(req.ctx.ptr, req.ptr, ptr)
+
+	return &UbusDeferredRequest{ctx: req.ctx, ptr: ptr}
+}
+
+// queue a reply, it is sent from the uloop thread
+func (d *UbusDeferredRequest) Reply(msg any) error {
+	buf := NewBlobBuf()
+	buf.Init(0)
+	if err := buf.AddMessage(msg); err != nil {
+		buf.Free()
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done {
+		buf.Free()
+		return errors.New("ng: deferred request already completed")
+	}
+
+	err := uloopPost(func() {
+		C.ubus_send_reply(d.ctx.ptr, d.ptr, buf.ptr.head)
+		buf.Free()
+	})
+	if err != nil {
+		buf.Free()
+	}
+
+	return err
+}
+
+// encapsulate ubus_complete_deferred_request, queued after the replies. the
+// request stays open when it can't be queued
+func (d *UbusDeferredRequest) Complete(status UbusStatus) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done {
+		return errors.New("ng: deferred request already completed")
+	}
+
+	err := uloopPost(func() {
+		C.ubus_complete_deferred_request(d.ctx.ptr, d.ptr, C.int(status))
+		C.free(unsafe.Pointer(d.ptr))
+	})
+	if err != nil {
+		return err
+	}
+
+	d.done = true
+	return nil
 }
 
 // encapsulate ubus_add_object
 func (ctx *UbusContext) AddObject(obj *UbusObject) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.AddObject(obj) })
+	}
+
 	freePtr := _UbusObjectPtr{}
 	freePtr.init()
 	defer func() {
@@ -336,7 +616,7 @@ func (ctx *UbusContext) AddObject(obj *UbusObject) error {
 		cObjPtr.n_methods = 0
 	} else {
 		cMethods := make([]C.struct_ubus_method, 0)
-		for _, method := range obj.Methods {
+		for _, method := range obj.wrapped().Methods {
 			cMethodName := C.CString(method.Name)
 			// ^defer free
 			freePtr.methodNames = append(freePtr.methodNames, cMethodName)
@@ -364,7 +644,9 @@ func (ctx *UbusContext) AddObject(obj *UbusObject) error {
 
 			cMethods = append(cMethods, cMethod)
 
-			lang.AddDMapValue(ubusHandlerMap, obj.Name, method.Name, method.Handler)
+			ctx.mutex.Lock()
+			lang.AddDMapValue(ctx.methods, obj.Name, method.Name, method)
+			ctx.mutex.Unlock()
 		}
 
 		cMethodPtr := (*C.struct_ubus_method)(C.calloc(C.ulong(len(cMethods)), C.sizeof_struct_ubus_method))
@@ -384,29 +666,223 @@ func (ctx *UbusContext) AddObject(obj *UbusObject) error {
 		return err
 	}
 	if ret != C.UBUS_STATUS_OK {
-		return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+		return UbusStatus(ret)
 	}
 
 	freePtr.ready = true
 	ctx.ubusObjPtrMap[obj.Name] = freePtr
+	obj.ctx = ctx
 
 	return nil
 }
 
 // encapsulate ubus_remove_object
 func (ctx *UbusContext) RemoveObject(name string) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.RemoveObject(name) })
+	}
+
 	if ptr, ok := ctx.ubusObjPtrMap[name]; ok {
 		ret, err := C.ubus_remove_object(ctx.ptr, ptr.objPtr)
 		if err != nil {
 			return err
 		}
 		if ret != C.UBUS_STATUS_OK {
-			return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+			return UbusStatus(ret)
 		}
 
+		ptr.ready = false
 		ptr.free()
 
 		delete(ctx.ubusObjPtrMap, name)
+
+		ctx.mutex.Lock()
+		delete(ctx.methods, name)
+		ctx.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// encapsulate ubus_notify with a negative timeout, subscribers don't reply
+func (ctx *UbusContext) Notify(obj string, typ string, msg any) (err error) {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.Notify(obj, typ, msg) })
+	}
+
+	ptr, ok := ctx.ubusObjPtrMap[obj]
+	if !ok {
+		return UBUS_STATUS_NOT_FOUND
+	}
+	defer func() {
+		ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_NOTIFY, Object: obj, Id: uint32(ptr.objPtr.id), Method: typ, Status: UbusStatusOf(err)}, msg)
+	}()
+
+	buf := NewBlobBuf()
+	defer buf.Free()
+
+	buf.Init(0)
+	if err := buf.AddMessage(msg); err != nil {
+		return err
+	}
+
+	ctyp := C.CString(typ)
+	defer C.free(unsafe.Pointer(ctyp))
+
+	lockUbus(context.Background())
+	defer unlockUbus()
+	ret, err := C.ubus_notify(ctx.ptr, ptr.objPtr, ctyp, buf.ptr.head, -1)
+	if err != nil {
+		return err
+	}
+	if ret != C.UBUS_STATUS_OK {
+		return UbusStatus(ret)
+	}
+
+	return nil
+}
+
+//export ubus_subscriber_handler_stub
+func ubus_subscriber_handler_stub(ctx *C.struct_ubus_context, obj *C.struct_ubus_object,
+	req *C.struct_ubus_request_data, method *C.char, msg *C.struct_blob_attr) C.int {
+	c := lookupUbusContext(ctx)
+	if c == nil {
+		return C.int(UBUS_STATUS_NOT_FOUND)
+	}
+
+	c.mutex.RLock()
+	s, ok := c.notify[obj]
+	c.mutex.RUnlock()
+
+	if !ok || s.Handler == nil {
+		return C.int(UBUS_STATUS_OK)
+	}
+
+	str := C.blobmsg_format_json_indent(msg, C.bool(true), C.int(0))
+	defer C.free(unsafe.Pointer(str))
+
+	typ, payload := C.GoString(method), C.GoString(str)
+	status := UbusStatusOf(s.Handler(typ, payload))
+	c.trace(&UbusTraceRecord{Kind: UBUS_TRACE_NOTIFICATION, Method: typ, Status: status}, payload)
+
+	return C.int(status)
+}
+
+//export ubus_subscriber_remove_stub
+func ubus_subscriber_remove_stub(ctx *C.struct_ubus_context, ptr *C.struct_ubus_subscriber, id C.uint32_t) {
+	c := lookupUbusContext(ctx)
+	if c == nil {
+		return
+	}
+
+	c.mutex.RLock()
+	s, ok := c.notify[&ptr.obj]
+	c.mutex.RUnlock()
+
+	if ok && s.RemoveHandler != nil {
+		s.RemoveHandler(uint32(id))
+	}
+}
+
+// encapsulate ubus_register_subscriber, does nothing if s is registered already
+func (ctx *UbusContext) RegisterSubscriber(s *UbusSubscriber) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.RegisterSubscriber(s) })
+	}
+
+	if _, ok := ctx.subscribers[s]; ok {
+		return nil
+	}
+
+	ptr := (*C.struct_ubus_subscriber)(C.calloc(1, C.sizeof_struct_ubus_subscriber))
+	C.bind_ubus_subscriber(ptr)
+
+	ret, err := C.ubus_register_subscriber(ctx.ptr, ptr)
+	if err != nil {
+		C.free(unsafe.Pointer(ptr))
+		return err
+	}
+	if ret != C.UBUS_STATUS_OK {
+		C.free(unsafe.Pointer(ptr))
+		return UbusStatus(ret)
+	}
+
+	ctx.mutex.Lock()
+	ctx.notify[&ptr.obj] = s
+	ctx.mutex.Unlock()
+	ctx.subscribers[s] = ptr
+
+	return nil
+}
+
+// encapsulate ubus_unregister_subscriber, drops all of its subscriptions
+func (ctx *UbusContext) UnregisterSubscriber(s *UbusSubscriber) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.UnregisterSubscriber(s) })
+	}
+
+	if ptr, ok := ctx.subscribers[s]; ok {
+		ret, err := C.ubus_unregister_subscriber(ctx.ptr, ptr)
+		if err != nil {
+			return err
+		}
+		if ret != C.UBUS_STATUS_OK {
+			return UbusStatus(ret)
+		}
+
+		ctx.mutex.Lock()
+		delete(ctx.notify, &ptr.obj)
+		ctx.mutex.Unlock()
+		delete(ctx.subscribers, s)
+		C.free(unsafe.Pointer(ptr))
+	}
+
+	return nil
+}
+
+// encapsulate ubus_subscribe, s must be registered
+func (ctx *UbusContext) Subscribe(s *UbusSubscriber, id uint32) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.Subscribe(s, id) })
+	}
+
+	ptr, ok := ctx.subscribers[s]
+	if !ok {
+		return errors.New("ng: ubus subscriber not registered")
+	}
+
+	lockUbus(context.Background())
+	defer unlockUbus()
+	ret, err := C.ubus_subscribe(ctx.ptr, ptr, C.uint32_t(id))
+	if err != nil {
+		return err
+	}
+	if ret != C.UBUS_STATUS_OK {
+		return UbusStatus(ret)
+	}
+
+	return nil
+}
+
+// encapsulate ubus_unsubscribe
+func (ctx *UbusContext) Unsubscribe(s *UbusSubscriber, id uint32) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.Unsubscribe(s, id) })
+	}
+
+	ptr, ok := ctx.subscribers[s]
+	if !ok {
+		return errors.New("ng: ubus subscriber not registered")
+	}
+
+	lockUbus(context.Background())
+	defer unlockUbus()
+	ret, err := C.ubus_unsubscribe(ctx.ptr, ptr, C.uint32_t(id))
+	if err != nil {
+		return err
+	}
+	if ret != C.UBUS_STATUS_OK {
+		return UbusStatus(ret)
 	}
 
 	return nil
@@ -414,22 +890,26 @@ func (ctx *UbusContext) RemoveObject(name string) error {
 
 // encapsulate ubus_send_reply
 func (ctx *UbusContext) SendReply(req *UbusRequestData, msg any) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.SendReply(req, msg) })
+	}
+
 	buf := NewBlobBuf()
 	defer buf.Free()
 
 	buf.Init(0)
-	if err := buf.AddJsonFrom(msg); err != nil {
+	if err := buf.AddMessage(msg); err != nil {
 		return err
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	lockUbus(context.Background())
+	defer unlockUbus()
 	ret, err := C.ubus_send_reply(ctx.ptr, req.ptr, buf.ptr.head)
 	if err != nil {
 		return err
 	}
 	if ret != C.UBUS_STATUS_OK {
-		return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+		return UbusStatus(ret)
 	}
 
 	return nil
@@ -437,6 +917,21 @@ func (ctx *UbusContext) SendReply(req *UbusRequestData, msg any) error {
 
 // encapsulate ubus_lookup_id
 func (ctx *UbusContext) LookupId(path string) (uint32, error) {
+	return ctx.LookupIdContext(context.Background(), path)
+}
+
+func (ctx *UbusContext) LookupIdContext(goCtx context.Context, path string) (uint32, error) {
+	if ctx.remote() {
+		return _UloopCall(goCtx, func() (uint32, error) {
+			return ctx.LookupIdContext(goCtx, path)
+		})
+	}
+
+	if err := lockUbus(goCtx); err != nil {
+		return 0, err
+	}
+	defer unlockUbus()
+
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
@@ -447,30 +942,181 @@ func (ctx *UbusContext) LookupId(path string) (uint32, error) {
 		return 0, err
 	}
 	if ret != C.UBUS_STATUS_OK {
-		return 0, fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+		return 0, UbusStatus(ret)
 	}
+	_TracerOf(ctx).lookup(path, uint32(id))
 
 	return uint32(id), nil
 }
 
+//export ubus_lookup_handler_stub
+func ubus_lookup_handler_stub(ctx *C.struct_ubus_context, obj *C.struct_ubus_object_data, priv unsafe.Pointer) {
+	objects := cgo.Handle(priv).Value().(*[]UbusObjectData)
+	object := UbusObjectData{
+		Id:     uint32(obj.id),
+		TypeId: uint32(obj.type_id),
+		Path:   C.GoString(obj.path),
+	}
+
+	if obj.signature != nil {
+		data := C.GoBytes(C.blob_data(obj.signature), C.int(C.blob_len(obj.signature)))
+		if signature, err := _ParseUbusSignature(data); err == nil {
+			object.Signature = signature
+		}
+	}
+
+	*objects = append(*objects, object)
+}
+
+// encapsulate ubus_lookup, a blank pattern for all objects
+func (ctx *UbusContext) Lookup(pattern string) ([]UbusObjectData, error) {
+	return ctx.LookupContext(context.Background(), pattern)
+}
+
+func (ctx *UbusContext) LookupContext(goCtx context.Context, pattern string) ([]UbusObjectData, error) {
+	if ctx.remote() {
+		return _UloopCall(goCtx, func() ([]UbusObjectData, error) {
+			return ctx.LookupContext(goCtx, pattern)
+		})
+	}
+
+	if err := lockUbus(goCtx); err != nil {
+		return nil, err
+	}
+	defer unlockUbus()
+
+	var cpattern *C.char
+	if pattern != "" {
+		cpattern = C.CString(pattern)
+		defer C.free(unsafe.Pointer(cpattern))
+	}
+
+	objects := make([]UbusObjectData, 0)
+	handle := cgo.NewHandle(&objects)
+	defer handle.Delete()
+
+	ret, err := C.ubus_lookup_objects(ctx.ptr, cpattern, C.uintptr_t(handle))
+	if err != nil {
+		return nil, err
+	}
+	if ret != C.UBUS_STATUS_OK {
+		return nil, UbusStatus(ret)
+	}
+	for _, object := range objects {
+		_TracerOf(ctx).lookup(object.Path, object.Id)
+	}
+
+	return objects, nil
+}
+
 //export ubus_data_handler_stub
 func ubus_data_handler_stub(req *C.struct_ubus_request, typ C.int, msg *C.struct_blob_attr) {
+	c := lookupUbusContext(req.ctx)
+	if c == nil {
+		return
+	}
+
 	seq := int32(req.seq)
 
-	if handler, ok := ubusDataHandlerMap[seq]; ok {
-		defer delete(ubusDataHandlerMap, seq)
+	// called for every data message, until the first error. the handler is
+	// removed once the request is complete
+	c.mutex.Lock()
+	handler, ok := c.dataHandlers[seq]
+	_, failed := c.dataErrors[seq]
+	c.mutex.Unlock()
 
+	if ok && handler != nil && !failed {
 		str := C.blobmsg_format_json_indent(msg, C.bool(true), C.int(0))
 		defer C.free(unsafe.Pointer(str))
 
 		if err := handler(C.GoString(str)); err != nil {
-			ubusDataHandlerErrors[seq] = err
+			c.mutex.Lock()
+			c.dataErrors[seq] = err
+			c.mutex.Unlock()
 		}
 	}
 }
 
-// encapsulate ubus invoke
+//export ubus_fd_handler_stub
+func ubus_fd_handler_stub(req *C.struct_ubus_request, fd C.int) {
+	c := lookupUbusContext(req.ctx)
+	if c == nil {
+		syscall.Close(int(fd))
+		return
+	}
+
+	c.mutex.RLock()
+	handler, ok := c.fileHandlers[int32(req.seq)]
+	c.mutex.RUnlock()
+
+	if !ok {
+		syscall.Close(int(fd))
+		return
+	}
+
+	handler(os.NewFile(uintptr(fd), "ubus"))
+}
+
+// encapsulate ubus invoke. cb is called for every data message of the reply, in
+// order
 func (ctx *UbusContext) Invoke(id uint32, method string, param any, timeout int, cb UbusDataHandler) error {
+	return ctx.invoke(context.Background(), id, method, param, timeout, nil, cb)
+}
+
+// the deadline of goCtx is the invoke timeout (DEFAULT_INVOKE_TIMEOUT without one).
+// cancellation is observed while waiting for other calls and before the request
+// is sent, libubus can't abandon a request that is in flight
+func (ctx *UbusContext) InvokeContext(goCtx context.Context, id uint32, method string, param any, cb UbusDataHandler) error {
+	timeout, err := _UbusInvokeTimeout(goCtx)
+	if err != nil {
+		return err
+	}
+
+	return ctx.invoke(goCtx, id, method, param, timeout, nil, cb)
+}
+
+// timeout of an invoke made with goCtx, what is left until its deadline
+func _UbusInvokeTimeout(goCtx context.Context) (int, error) {
+	deadline, ok := goCtx.Deadline()
+	if !ok {
+		return DEFAULT_INVOKE_TIMEOUT, nil
+	}
+
+	timeout := int(time.Until(deadline).Milliseconds())
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+
+	return timeout, nil
+}
+
+func (ctx *UbusContext) invoke(goCtx context.Context, id uint32, method string, param any, timeout int, opts *UbusInvokeOptions, cb UbusDataHandler) (err error) {
+	cb, done := ctx.traceInvoke(id, method, param, cb)
+	defer func() { done(err) }()
+
+	return ctx.invokeEach(goCtx, id, method, param, timeout, opts, cb)
+}
+
+// invoke without tracing, onReply is called on the uloop thread for every data
+// message and must not block
+func (ctx *UbusContext) invokeEach(goCtx context.Context, id uint32, method string, param any, timeout int, opts *UbusInvokeOptions, onReply UbusDataHandler) (err error) {
+	if ctx.remote() {
+		return ctx.post(goCtx, func() error { return ctx.invokeEach(goCtx, id, method, param, timeout, opts, onReply) })
+	}
+
+	// libubus closes the fd once sent, it gets a copy
+	fd := -1
+	if opts != nil && opts.File != nil {
+		if fd, err = syscall.Dup(int(opts.File.Fd())); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}()
+
 	cmethod := C.CString(method)
 	defer C.free(unsafe.Pointer(cmethod))
 
@@ -478,26 +1124,50 @@ func (ctx *UbusContext) Invoke(id uint32, method string, param any, timeout int,
 	defer buf.Free()
 
 	buf.Init(0)
-	buf.AddJsonFrom(param)
+	if err := buf.AddMessage(param); err != nil {
+		return err
+	}
 
 	req := (*C.struct_ubus_request)(C.calloc(1, C.sizeof_struct_ubus_request))
 	defer C.free(unsafe.Pointer(req))
 
-	var err error
 	var ret C.int
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	if ret, err = C.ubus_invoke_async(ctx.ptr, C.uint32_t(id), cmethod, buf.ptr.head, req); err != nil {
+	if err = lockUbus(goCtx); err != nil {
+		return err
+	}
+	defer unlockUbus()
+	if err = goCtx.Err(); err != nil {
+		return err
+	}
+
+	ret, err = C.ubus_invoke_async_fd(ctx.ptr, C.uint32_t(id), cmethod, buf.ptr.head, req, C.int(fd))
+	fd = -1
+	if err != nil {
 		return err
 	}
 	if ret != C.UBUS_STATUS_OK {
-		return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+		return UbusStatus(ret)
 	}
 
 	req.data_cb = C.ubus_data_handler_t(C.ubus_data_handler_stub)
 	seq := int32(req.seq)
-	ubusDataHandlerMap[seq] = cb
+	ctx.mutex.Lock()
+	ctx.dataHandlers[seq] = onReply
+	if opts != nil && opts.OnFile != nil {
+		req.fd_cb = C.ubus_fd_handler_t(C.ubus_fd_handler_stub)
+		ctx.fileHandlers[seq] = opts.OnFile
+	}
+	ctx.mutex.Unlock()
+
+	defer func() {
+		// left behind by a request without reply or a failed one
+		ctx.mutex.Lock()
+		delete(ctx.dataHandlers, seq)
+		delete(ctx.dataErrors, seq)
+		delete(ctx.fileHandlers, seq)
+		ctx.mutex.Unlock()
+	}()
 
 	retry := 5
 	for i := 0; i < retry; i++ {
@@ -508,40 +1178,57 @@ func (ctx *UbusContext) Invoke(id uint32, method string, param any, timeout int,
 		break
 	}
 
+	if ret == C.UBUS_STATUS_TIMEOUT && goCtx.Err() != nil {
+		return goCtx.Err()
+	}
 	if err != nil {
 		return err
 	}
 	if ret != C.UBUS_STATUS_OK {
-		return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+		return UbusStatus(ret)
 	}
 
-	if err, ok := ubusDataHandlerErrors[seq]; ok {
-		defer delete(ubusDataHandlerErrors, seq)
-		return err
-	}
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
 
-	return nil
+	return ctx.dataErrors[seq]
 }
 
 //export ubus_event_handler_stub
 func ubus_event_handler_stub(ctx *C.struct_ubus_context, ev *C.struct_ubus_event_handler, typ *C.char, msg *C.struct_blob_attr) {
-	id := C.GoString(typ)
+	c := lookupUbusContext(ctx)
+	if c == nil {
+		return
+	}
+
+	// ubusd matched the pattern of the listener already
+	c.mutex.RLock()
+	handler, ok := c.events[ev]
+	c.mutex.RUnlock()
+
+	if !ok {
+		return
+	}
+
 	str := C.blobmsg_format_json_indent(msg, C.bool(true), C.int(0))
 	defer C.free(unsafe.Pointer(str))
 
-	for pattern, handler := range ubusEventHandlerMap {
-		matched, err := path.Match(pattern, id)
-		if err != nil {
-			continue
-		}
-		if matched {
-			handler(id, C.GoString(str))
-		}
-	}
+	id, payload := C.GoString(typ), C.GoString(str)
+	c.trace(&UbusTraceRecord{Kind: UBUS_TRACE_EVENT, Method: id}, payload)
+	handler(id, payload)
 }
 
 // encapsulate ubus_register_event_handler
 func (ctx *UbusContext) RegisterEvent(pattern string, cb UbusEventHandler) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.RegisterEvent(pattern, cb) })
+	}
+
+	// a pattern has one listener, registering again replaces the handler
+	if err := ctx.UnregisterEvent(pattern); err != nil {
+		return err
+	}
+
 	listener := _UbusEventListener{
 		ptr: (*C.struct_ubus_event_handler)(C.calloc(1, C.sizeof_struct_ubus_event_handler)),
 	}
@@ -551,15 +1238,24 @@ func (ctx *UbusContext) RegisterEvent(pattern string, cb UbusEventHandler) error
 
 	C.bind_ubus_event_handler(listener.ptr)
 
+	// registered first, events may arrive before ubusd replies
+	ctx.mutex.Lock()
+	ctx.events[listener.ptr] = cb
+	ctx.mutex.Unlock()
+
 	ret, err := C.ubus_register_event_handler(ctx.ptr, listener.ptr, cpattern)
+	if err == nil && ret != C.UBUS_STATUS_OK {
+		err = UbusStatus(ret)
+	}
 	if err != nil {
+		ctx.mutex.Lock()
+		delete(ctx.events, listener.ptr)
+		ctx.mutex.Unlock()
+
+		listener.free()
 		return err
 	}
-	if ret != C.UBUS_STATUS_OK {
-		return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
-	}
 
-	ubusEventHandlerMap[pattern] = cb
 	ctx.listeners[pattern] = listener
 
 	return nil
@@ -567,16 +1263,25 @@ func (ctx *UbusContext) RegisterEvent(pattern string, cb UbusEventHandler) error
 
 // encapsulate ubus_unregister_event_handler
 func (ctx *UbusContext) UnregisterEvent(pattern string) error {
+	if ctx.remote() {
+		return ctx.post(context.Background(), func() error { return ctx.UnregisterEvent(pattern) })
+	}
+
 	if listener, ok := ctx.listeners[pattern]; ok {
 		ret, err := C.ubus_unregister_event_handler(ctx.ptr, listener.ptr)
 		if err != nil {
 			return err
 		}
 		if ret != C.UBUS_STATUS_OK {
-			return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+			return UbusStatus(ret)
 		}
 
+		ctx.mutex.Lock()
+		delete(ctx.events, listener.ptr)
+		ctx.mutex.Unlock()
+
 		listener.free()
+		delete(ctx.listeners, pattern)
 	}
 
 	return nil
@@ -584,31 +1289,45 @@ func (ctx *UbusContext) UnregisterEvent(pattern string) error {
 
 // encapsulate ubus_send_event
 func (ctx *UbusContext) SendEvent(id string, msg any) error {
+	return ctx.SendEventContext(context.Background(), id, msg)
+}
+
+func (ctx *UbusContext) SendEventContext(goCtx context.Context, id string, msg any) (err error) {
+	if ctx.remote() {
+		return ctx.post(goCtx, func() error { return ctx.SendEventContext(goCtx, id, msg) })
+	}
+
+	defer func() {
+		ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_SEND_EVENT, Method: id, Status: UbusStatusOf(err)}, msg)
+	}()
+
 	buf := NewBlobBuf()
 	defer buf.Free()
 
 	buf.Init(0)
-	if err := buf.AddJsonFrom(msg); err != nil {
+	if err := buf.AddMessage(msg); err != nil {
 		return err
 	}
 
 	cid := C.CString(id)
 	defer C.free(unsafe.Pointer(cid))
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err := lockUbus(goCtx); err != nil {
+		return err
+	}
+	defer unlockUbus()
 	ret, err := C.ubus_send_event(ctx.ptr, cid, buf.ptr.head)
 	if err != nil {
 		return err
 	}
 	if ret != C.UBUS_STATUS_OK {
-		return fmt.Errorf("%d: %s", int(ret), UbusErrorString(ret))
+		return UbusStatus(ret)
 	}
 
 	return nil
 }
 
 // encapsulate ubus_strerror
-func UbusErrorString(code C.int) string {
-	return C.GoString(C.ubus_strerror(code))
+func UbusErrorString(code int) string {
+	return C.GoString(C.ubus_strerror(C.int(code)))
 }
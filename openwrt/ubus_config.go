@@ -0,0 +1,96 @@
+package openwrt
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	// delay before the first reconnect attempt
+	DEFAULT_RECONNECT_BACKOFF = time.Second
+	// longest delay between reconnect attempts
+	DEFAULT_RECONNECT_MAX_BACKOFF = 30 * time.Second
+)
+
+// settings of a connection to ubusd, fields left zero take their defaults
+type UbusConfig struct {
+	// unix socket of ubusd, DEFAULT_SOCK by default
+	Sock string
+	// reconnect when the connection is lost, objects, event listeners and
+	// subscribers get registered again
+	Reconnect bool
+	// make the calls of the context on a uloop thread, see NewUbusLoopContext
+	Loop bool
+
+	// delay before the first reconnect attempt, doubled after each failed one
+	// up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// random part added to each delay, as a fraction of it from 0 to 1
+	Jitter float64
+	// give up after that many failed attempts, 0 tries forever
+	MaxAttempts int
+
+	// called when the connection is lost, before reconnecting
+	OnDisconnect func()
+	// called once connected again and registered
+	OnReconnect func()
+}
+
+func _ResolveUbusConfig(config *UbusConfig) UbusConfig {
+	resolved := UbusConfig{}
+	if config != nil {
+		resolved = *config
+	}
+
+	if resolved.Sock == "" {
+		resolved.Sock = DEFAULT_SOCK
+	}
+	if resolved.Backoff <= 0 {
+		resolved.Backoff = DEFAULT_RECONNECT_BACKOFF
+	}
+	if resolved.MaxBackoff <= 0 {
+		resolved.MaxBackoff = DEFAULT_RECONNECT_MAX_BACKOFF
+	}
+	if resolved.MaxBackoff < resolved.Backoff {
+		resolved.MaxBackoff = resolved.Backoff
+	}
+
+	return resolved
+}
+
+// delay before reconnect attempt n, counted from 0
+func (config *UbusConfig) backoff(n int) time.Duration {
+	delay := config.Backoff
+	for i := 0; i < n && delay < config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > config.MaxBackoff {
+		delay = config.MaxBackoff
+	}
+
+	if config.Jitter > 0 {
+		delay += time.Duration(rand.Float64() * config.Jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// call connect after each backoff until it succeeds. false once the attempts
+// are used up or goCtx is done
+func (config *UbusConfig) retry(goCtx context.Context, connect func() bool) bool {
+	for n := 0; config.MaxAttempts <= 0 || n < config.MaxAttempts; n++ {
+		select {
+		case <-time.After(config.backoff(n)):
+		case <-goCtx.Done():
+			return false
+		}
+
+		if connect() {
+			return true
+		}
+	}
+
+	return false
+}
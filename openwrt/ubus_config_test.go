@@ -0,0 +1,49 @@
+package openwrt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUbusConfigBackoff(t *testing.T) {
+	config := _ResolveUbusConfig(&UbusConfig{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+
+	expect := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for n, delay := range expect {
+		if got := config.backoff(n); got != delay*time.Millisecond {
+			t.Errorf("attempt %d: expect %v, got %v", n, delay*time.Millisecond, got)
+		}
+	}
+
+	config.Jitter = 0.5
+	for n := 0; n < 10; n++ {
+		if got := config.backoff(4); got < time.Second || got > 1500*time.Millisecond {
+			t.Errorf("jitter out of range: %v", got)
+		}
+	}
+
+	if defaults := _ResolveUbusConfig(nil); defaults.Sock != DEFAULT_SOCK || defaults.backoff(0) != DEFAULT_RECONNECT_BACKOFF {
+		t.Errorf("unexpected defaults %+v", defaults)
+	}
+}
+
+func TestUbusConfigRetry(t *testing.T) {
+	config := _ResolveUbusConfig(&UbusConfig{Backoff: time.Millisecond, MaxAttempts: 3})
+
+	attempts := 0
+	if config.retry(context.Background(), func() bool { attempts++; return false }) || attempts != 3 {
+		t.Errorf("expect to give up after 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	if !config.retry(context.Background(), func() bool { attempts++; return attempts == 2 }) || attempts != 2 {
+		t.Errorf("expect success on attempt 2, got %d", attempts)
+	}
+
+	goCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if config.retry(goCtx, func() bool { return true }) {
+		t.Errorf("expect no attempt once the context is done")
+	}
+}
@@ -0,0 +1,109 @@
+package openwrt
+
+import (
+	"sync"
+)
+
+// the listeners of a context by pattern, sharing one event handler each
+type _UbusEventFanout struct {
+	// serializes registering the handlers. not under mutex, events may be
+	// waiting for it on the uloop thread
+	registerMutex sync.Mutex
+
+	// guards the fields below
+	mutex    sync.Mutex
+	seq      int
+	patterns map[string][]_UbusEventListenerEntry
+}
+
+type _UbusEventListenerEntry struct {
+	id int
+	cb UbusEventHandler
+}
+
+/*
+Call cb for the events matching pattern, until stop is called. unlike
+RegisterEvent, any number of listeners share a pattern: its handler is
+registered for the first and unregistered after the last one stopped.
+
+RegisterEvent and UnregisterEvent replace the shared handler, a pattern is
+either listened to or registered. with libubus the uloop has to run for cb to
+be called.
+*/
+func (ctx *UbusContext) ListenEvent(pattern string, cb UbusEventHandler) (stop func() error, err error) {
+	f := &ctx.fanout
+
+	f.registerMutex.Lock()
+	defer f.registerMutex.Unlock()
+
+	f.mutex.Lock()
+	registered := len(f.patterns[pattern]) > 0
+	f.mutex.Unlock()
+
+	if !registered {
+		if err := ctx.RegisterEvent(pattern, func(event string, msg string) {
+			f.dispatch(pattern, event, msg)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mutex.Lock()
+	if f.patterns == nil {
+		f.patterns = make(map[string][]_UbusEventListenerEntry)
+	}
+	f.seq++
+	id := f.seq
+	f.patterns[pattern] = append(f.patterns[pattern], _UbusEventListenerEntry{id, cb})
+	f.mutex.Unlock()
+
+	return func() error {
+		f.registerMutex.Lock()
+		defer f.registerMutex.Unlock()
+
+		if !f.remove(pattern, id) {
+			return nil
+		}
+
+		return ctx.UnregisterEvent(pattern)
+	}, nil
+}
+
+func (client *UbusClient) ListenEvent(pattern string, cb UbusEventHandler) (stop func() error, err error) {
+	return client.Context.ListenEvent(pattern, cb)
+}
+
+// remove the listener id of pattern, true if it was the last one
+func (f *_UbusEventFanout) remove(pattern string, id int) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	entries := f.patterns[pattern]
+	for i := range entries {
+		if entries[i].id != id {
+			continue
+		}
+
+		if len(entries) == 1 {
+			delete(f.patterns, pattern)
+			return true
+		}
+
+		// copied, dispatch may still be going through the old slice
+		f.patterns[pattern] = append(append([]_UbusEventListenerEntry{}, entries[:i]...), entries[i+1:]...)
+		return false
+	}
+
+	return false
+}
+
+// hand an event to the listeners of pattern, in the order they started
+func (f *_UbusEventFanout) dispatch(pattern string, event string, msg string) {
+	f.mutex.Lock()
+	entries := f.patterns[pattern]
+	f.mutex.Unlock()
+
+	for _, entry := range entries {
+		entry.cb(event, msg)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func TestUbusRegisterEventTwice(t *testing.T) {
+	b := ubustest.Start(t)
+	client := b.NewClient(t)
+
+	first, second := make(chan string, 4), make(chan string, 4)
+	if err := client.Context.RegisterEvent("test.*", func(event string, msg string) {
+		first <- event
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Context.RegisterEvent("test.*", func(event string, msg string) {
+		second <- event
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := b.NewClient(t)
+	if err := sender.SendEvent("test.a", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ubustest.Wait(t, second); got != "test.a" {
+		t.Fatalf("unexpected event %s", got)
+	}
+	select {
+	case got := <-first:
+		t.Fatalf("unexpected event %s for the replaced handler", got)
+	case got := <-second:
+		t.Fatalf("event %s delivered twice", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// one unregister removes the pattern
+	if err := client.Context.UnregisterEvent("test.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendEvent("test.b", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-first:
+		t.Fatalf("unexpected event %s after unregister", got)
+	case got := <-second:
+		t.Fatalf("unexpected event %s after unregister", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUbusListenEvent(t *testing.T) {
+	b := ubustest.Start(t)
+	client := b.NewClient(t)
+
+	first, second := make(chan string, 4), make(chan string, 4)
+	stopFirst, err := client.ListenEvent("test.*", func(event string, msg string) {
+		first <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopSecond, err := client.ListenEvent("test.*", func(event string, msg string) {
+		second <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := b.NewClient(t)
+	if err := sender.SendEvent("test.a", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := ubustest.Wait(t, first), ubustest.Wait(t, second); a != "test.a" || b != "test.a" {
+		t.Fatalf("unexpected events %s %s", a, b)
+	}
+
+	// the other listener keeps the pattern
+	if err := stopFirst(); err != nil {
+		t.Fatal(err)
+	}
+	stopFirst()
+	if err := sender.SendEvent("test.b", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ubustest.Wait(t, second); got != "test.b" {
+		t.Fatalf("unexpected event %s", got)
+	}
+	select {
+	case got := <-first:
+		t.Fatalf("unexpected event %s after stop", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := stopSecond(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the watcher shares ubus.object.* with the listeners of the pattern
+	watched, listened := make(chan string, 1), make(chan string, 1)
+	stopWatch, err := client.Context.WatchObjects(func(added bool, obj openwrt.UbusObjectData) {
+		watched <- obj.Path
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopWatch()
+	stopListen, err := client.ListenEvent("ubus.object.*", func(event string, msg string) {
+		listened <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopListen()
+
+	b.AddObject("late")
+	if got := ubustest.Wait(t, watched); got != "late" {
+		t.Fatalf("unexpected object %s", got)
+	}
+	if got := ubustest.Wait(t, listened); got != openwrt.UBUS_EVENT_OBJECT_ADD {
+		t.Fatalf("unexpected event %s", got)
+	}
+}
@@ -0,0 +1,36 @@
+package openwrt
+
+import (
+	"context"
+	"os"
+)
+
+// options of InvokeWithOptions
+type UbusInvokeOptions struct {
+	// sent along with the call, see UbusRequestData.CallerFile. it stays open,
+	// the caller may close it once the invoke returned
+	File *os.File
+	// called before the invoke returns with the file attached to the reply, see
+	// UbusRequestData.SetReplyFile. the callback owns it, without one it's closed
+	OnFile func(f *os.File)
+}
+
+// same as InvokeContext, passing files along with the call and its reply like
+// ubus_invoke_async_fd and the fd_cb of ubus_request do
+func (ctx *UbusContext) InvokeWithOptions(goCtx context.Context, id uint32, method string, param any, opts *UbusInvokeOptions, cb UbusDataHandler) error {
+	timeout, err := _UbusInvokeTimeout(goCtx)
+	if err != nil {
+		return err
+	}
+
+	return ctx.invoke(goCtx, id, method, param, timeout, opts, cb)
+}
+
+func (client *UbusClient) InvokeWithOptions(goCtx context.Context, obj string, method string, param any, opts *UbusInvokeOptions, cb UbusDataHandler) error {
+	id, err := client.Context.LookupIdContext(goCtx, obj)
+	if err != nil {
+		return err
+	}
+
+	return client.Context.InvokeWithOptions(goCtx, id, method, param, opts, cb)
+}
@@ -0,0 +1,68 @@
+//go:build cgo && !ubus_native
+
+package openwrt_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func newLoopClient(t *testing.T, b *ubustest.Broker) *openwrt.UbusClient {
+	client, err := openwrt.NewUbusClientWithConfig(context.Background(), &openwrt.UbusConfig{Sock: b.Sock, Loop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Free)
+
+	return client
+}
+
+// libubus closes the caller fd after the handler unless CallerFile took it
+func TestUbusCallerFileOwnership(t *testing.T) {
+	b := ubustest.Start(t)
+
+	files := make(chan *os.File, 1)
+	server := newLoopClient(t, b)
+	obj := openwrt.UbusObject{Name: "file"}
+	obj.AddMethod("take", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		in := req.CallerFile()
+		if in == nil || req.CallerFile() != nil {
+			return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+		}
+
+		files <- in
+		return nil
+	})
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("hello")
+	w.Close()
+
+	client := newLoopClient(t, b)
+	err = client.InvokeWithOptions(context.Background(), "file", "take", nil, &openwrt.UbusInvokeOptions{File: r}, nil)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// still open after the handler returned
+	in := ubustest.Wait(t, files)
+	defer in.Close()
+
+	data, err := io.ReadAll(in)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected caller file %q, %v", data, err)
+	}
+}
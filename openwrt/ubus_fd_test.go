@@ -0,0 +1,82 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func TestUbusInvokeFile(t *testing.T) {
+	b := ubustest.Start(t)
+
+	server := b.NewClient(t)
+	obj := openwrt.UbusObject{Name: "file"}
+	obj.AddMethod("swap", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		in := req.CallerFile()
+		if in == nil {
+			return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+		}
+		defer in.Close()
+		if req.CallerFile() != nil {
+			return openwrt.UBUS_STATUS_UNKNOWN_ERROR
+		}
+
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		defer w.Close()
+
+		w.Write(bytes.ToUpper(data))
+		return req.SetReplyFile(r)
+	})
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("hello")
+	w.Close()
+
+	files := make(chan *os.File, 1)
+	client := b.NewClient(t)
+	err = client.InvokeWithOptions(context.Background(), "file", "swap", nil, &openwrt.UbusInvokeOptions{
+		File:   r,
+		OnFile: func(f *os.File) { files <- f },
+	}, nil)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := ubustest.Wait(t, files)
+	defer f.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "HELLO" {
+		t.Errorf("unexpected reply file %q, %v", buf, err)
+	}
+
+	// without a file
+	err = client.InvokeWithOptions(context.Background(), "file", "swap", nil, nil, nil)
+	if openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_INVALID_ARGUMENT {
+		t.Errorf("expect invalid argument, got %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+package openwrt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/json"
+)
+
+// JSON-RPC error codes, the same as uhttpd-mod-ubus
+const (
+	UBUS_GATEWAY_PARSE_ERROR      = -32700
+	UBUS_GATEWAY_INVALID_REQUEST  = -32600
+	UBUS_GATEWAY_METHOD_NOT_FOUND = -32601
+	UBUS_GATEWAY_INVALID_PARAMS   = -32602
+	UBUS_GATEWAY_ACCESS_DENIED    = -32002
+)
+
+const (
+	// session of callers not logged in, as sent by the luci frontend
+	UBUS_GATEWAY_NO_SESSION = "00000000000000000000000000000000"
+	// largest request body accepted
+	UBUS_GATEWAY_MAX_BODY = 1048576
+)
+
+// what a request is about to do, see UbusGateway.Access
+type UbusGatewayAccess struct {
+	Session string
+	// call, list or subscribe
+	Op string
+	// object of a call, pattern of a list or an event stream
+	Object string
+	// method of a call
+	Method string
+}
+
+/*
+An http.Handler exposing ubus like uhttpd-mod-ubus does:
+
+  - POST a JSON-RPC 2.0 request or batch. "call" takes the params
+    [session, object, method, args] and results in [status, reply], the reply
+    left out when there is none. "list" takes [session, pattern...] and results
+    in the signatures of the objects by path, argument types named as in json
+  - GET .../subscribe/<pattern> streams the matching ubus events as
+    server-sent events, named by the event id. the session is taken from an
+    "Authorization: Bearer" header or the sid query parameter
+
+with libubus the uloop of the client has to run for events to arrive.
+*/
+type UbusGateway struct {
+	Client *UbusClient
+	// decide whether a request may go on, nil allows all. e.g. ask rpcd with
+	// a call of session.access
+	Access func(r *http.Request, access *UbusGatewayAccess) bool
+	// of a call, DEFAULT_INVOKE_TIMEOUT when 0
+	Timeout time.Duration
+}
+
+type _UbusGatewayEvent struct {
+	id   string
+	data string
+}
+
+type _UbusRpcRequest struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Id      any    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type _UbusRpcResponse struct {
+	Jsonrpc string         `json:"jsonrpc"`
+	Id      any            `json:"id"`
+	Result  any            `json:"result,omitempty"`
+	Error   *_UbusRpcError `json:"error,omitempty"`
+}
+
+type _UbusRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewUbusGateway(client *UbusClient) *UbusGateway {
+	return &UbusGateway{Client: client}
+}
+
+func (g *UbusGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		g.serveRpc(w, r)
+	case http.MethodGet:
+		i := strings.LastIndex(r.URL.Path, "/subscribe/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		g.serveEvents(w, r, r.URL.Path[i+len("/subscribe/"):])
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *UbusGateway) allowed(r *http.Request, access *UbusGatewayAccess) bool {
+	return g.Access == nil || g.Access(r, access)
+}
+
+func (g *UbusGateway) timeout() time.Duration {
+	if g.Timeout > 0 {
+		return g.Timeout
+	}
+
+	return DEFAULT_INVOKE_TIMEOUT * time.Millisecond
+}
+
+func _UbusRpcFailure(id any, code int, message string) *_UbusRpcResponse {
+	return &_UbusRpcResponse{Jsonrpc: "2.0", Id: id, Error: &_UbusRpcError{code, message}}
+}
+
+func (g *UbusGateway) serveRpc(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, UBUS_GATEWAY_MAX_BODY))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var ret any
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		var reqs []_UbusRpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			ret = _UbusRpcFailure(nil, UBUS_GATEWAY_PARSE_ERROR, err.Error())
+		} else {
+			resps := make([]*_UbusRpcResponse, 0, len(reqs))
+			for i := range reqs {
+				resps = append(resps, g.handleRpc(r, &reqs[i]))
+			}
+			ret = resps
+		}
+	} else {
+		var req _UbusRpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			ret = _UbusRpcFailure(nil, UBUS_GATEWAY_PARSE_ERROR, err.Error())
+		} else {
+			ret = g.handleRpc(r, &req)
+		}
+	}
+
+	data, err := json.Marshal(ret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (g *UbusGateway) handleRpc(r *http.Request, req *_UbusRpcRequest) *_UbusRpcResponse {
+	if req.Jsonrpc != "2.0" {
+		return _UbusRpcFailure(req.Id, UBUS_GATEWAY_INVALID_REQUEST, "Invalid request")
+	}
+
+	var params []string
+	for _, param := range req.Params {
+		str, ok := param.(string)
+		if !ok {
+			break
+		}
+		params = append(params, str)
+	}
+	if len(params) == 0 {
+		return _UbusRpcFailure(req.Id, UBUS_GATEWAY_INVALID_PARAMS, "Invalid parameters")
+	}
+
+	var result any
+	var fail *_UbusRpcError
+
+	switch req.Method {
+	case "call":
+		if len(params) < 3 || len(req.Params) > 4 {
+			return _UbusRpcFailure(req.Id, UBUS_GATEWAY_INVALID_PARAMS, "Invalid parameters")
+		}
+
+		var args any = map[string]any{}
+		if len(req.Params) == 4 {
+			if _, ok := req.Params[3].(map[string]any); !ok {
+				return _UbusRpcFailure(req.Id, UBUS_GATEWAY_INVALID_PARAMS, "Invalid parameters")
+			}
+			args = req.Params[3]
+		}
+
+		result, fail = g.call(r, &UbusGatewayAccess{Session: params[0], Op: "call", Object: params[1], Method: params[2]}, args)
+	case "list":
+		patterns := params[1:]
+		if len(patterns) == 0 {
+			patterns = []string{"*"}
+		}
+
+		result, fail = g.list(r, params[0], patterns)
+	default:
+		return _UbusRpcFailure(req.Id, UBUS_GATEWAY_METHOD_NOT_FOUND, "Method not found")
+	}
+
+	if fail != nil {
+		return &_UbusRpcResponse{Jsonrpc: "2.0", Id: req.Id, Error: fail}
+	}
+
+	return &_UbusRpcResponse{Jsonrpc: "2.0", Id: req.Id, Result: result}
+}
+
+func (g *UbusGateway) call(r *http.Request, access *UbusGatewayAccess, args any) (any, *_UbusRpcError) {
+	if !g.allowed(r, access) {
+		return nil, &_UbusRpcError{UBUS_GATEWAY_ACCESS_DENIED, "Access denied"}
+	}
+
+	// through json again, so integers are not sent as doubles
+	msg, err := json.MarshalToString(args)
+	if err != nil {
+		return nil, &_UbusRpcError{UBUS_GATEWAY_INVALID_PARAMS, err.Error()}
+	}
+
+	goCtx, cancel := context.WithTimeout(r.Context(), g.timeout())
+	defer cancel()
+
+	var reply any
+	id, err := g.Client.Context.LookupIdContext(goCtx, access.Object)
+	if err == nil {
+		err = g.Client.Context.InvokeContext(goCtx, id, access.Method, msg, func(msg string) error {
+			if reply != nil {
+				return nil
+			}
+			return json.UnmarshalFromString(msg, &reply)
+		})
+	}
+
+	result := []any{int(UbusStatusOf(err))}
+	if reply != nil {
+		result = append(result, reply)
+	}
+
+	return result, nil
+}
+
+func (g *UbusGateway) list(r *http.Request, session string, patterns []string) (any, *_UbusRpcError) {
+	goCtx, cancel := context.WithTimeout(r.Context(), g.timeout())
+	defer cancel()
+
+	result := make(map[string]map[string]map[string]string)
+	for _, pattern := range patterns {
+		if !g.allowed(r, &UbusGatewayAccess{Session: session, Op: "list", Object: pattern}) {
+			return nil, &_UbusRpcError{UBUS_GATEWAY_ACCESS_DENIED, "Access denied"}
+		}
+
+		objects, err := g.Client.Context.LookupContext(goCtx, pattern)
+		if err != nil && UbusStatusOf(err) != UBUS_STATUS_NOT_FOUND {
+			return nil, &_UbusRpcError{UBUS_GATEWAY_INVALID_REQUEST, err.Error()}
+		}
+
+		for _, obj := range objects {
+			methods := make(map[string]map[string]string, len(obj.Signature))
+			for method, fields := range obj.Signature {
+				args := make(map[string]string, len(fields))
+				for _, field := range fields {
+					args[field.Name] = _UbusGatewayTypeName(field.Type)
+				}
+				methods[method] = args
+			}
+			result[obj.Path] = methods
+		}
+	}
+
+	return result, nil
+}
+
+func _UbusGatewayTypeName(typ BlobmsgType) string {
+	switch typ {
+	case BLOBMSG_TYPE_ARRAY:
+		return "array"
+	case BLOBMSG_TYPE_TABLE:
+		return "object"
+	case BLOBMSG_TYPE_STRING:
+		return "string"
+	case BLOBMSG_TYPE_INT64, BLOBMSG_TYPE_INT32, BLOBMSG_TYPE_INT16, BLOBMSG_TYPE_DOUBLE:
+		return "number"
+	case BLOBMSG_TYPE_INT8, BLOBMSG_TYPE_BOOL:
+		return "boolean"
+	default:
+		return "unknown"
+	}
+}
+
+func (g *UbusGateway) serveEvents(w http.ResponseWriter, r *http.Request, pattern string) {
+	session := r.URL.Query().Get("sid")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		session = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if session == "" {
+		session = UBUS_GATEWAY_NO_SESSION
+	}
+
+	if pattern == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !g.allowed(r, &UbusGatewayAccess{Session: session, Op: "subscribe", Object: pattern}) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, stop, err := g.listen(pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev := <-ch:
+			_WriteUbusGatewayEvent(w, ev)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// write ev as a server-sent event, a data line per line of the json since
+// the cgo client indents it
+func _WriteUbusGatewayEvent(w io.Writer, ev _UbusGatewayEvent) {
+	data := strings.ReplaceAll(strings.TrimRight(ev.data, "\n"), "\n", "\ndata: ")
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.id, data)
+}
+
+// a channel of the events matching pattern, dropping those a slow stream
+// can't take
+func (g *UbusGateway) listen(pattern string) (chan _UbusGatewayEvent, func() error, error) {
+	ch := make(chan _UbusGatewayEvent, 16)
+
+	stop, err := g.Client.Context.ListenEvent(pattern, func(event string, msg string) {
+		select {
+		case ch <- _UbusGatewayEvent{event, msg}:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ch, stop, nil
+}
@@ -0,0 +1,22 @@
+package openwrt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteUbusGatewayEvent(t *testing.T) {
+	var builder strings.Builder
+	_WriteUbusGatewayEvent(&builder, _UbusGatewayEvent{"test.event", "{\n\t\"n\": 1\n}\n"})
+
+	expected := "event: test.event\ndata: {\ndata: \t\"n\": 1\ndata: }\n\n"
+	if builder.String() != expected {
+		t.Errorf("unexpected event %q", builder.String())
+	}
+
+	builder.Reset()
+	_WriteUbusGatewayEvent(&builder, _UbusGatewayEvent{"test.event", `{"n":1}`})
+	if builder.String() != "event: test.event\ndata: {\"n\":1}\n\n" {
+		t.Errorf("unexpected event %q", builder.String())
+	}
+}
@@ -0,0 +1,200 @@
+package openwrt
+
+import (
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/lang"
+	"github.com/hzwesoft-github/underscore/log"
+)
+
+// wrap a method handler with some behaviour, see UbusObject.Use
+type UbusMiddleware func(next UbusHandler) UbusHandler
+
+/*
+Wrap the handlers of all methods in mw, the first one is the outermost. the
+middlewares of the client adding the object run before these, see UbusClient.Use.
+
+takes effect when the object is added, e.g.
+
+	obj.Use(UbusRecoverMiddleware, UbusLogMiddleware, UbusAclMiddleware)
+*/
+func (obj *UbusObject) Use(mw ...UbusMiddleware) {
+	obj.Middlewares = append(obj.Middlewares, mw...)
+}
+
+// wrap the handlers of all objects added by Start, before the middlewares of
+// the objects
+func (client *UbusClient) Use(mw ...UbusMiddleware) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.Middlewares = append(client.Middlewares, mw...)
+}
+
+// a copy of obj whose method handlers are wrapped in its middlewares. the copy
+// has none left, so wrapping it again, e.g. when added after a reconnect, is a
+// no-op
+func (obj *UbusObject) wrapped() UbusObject {
+	ret := *obj
+	if len(obj.Middlewares) == 0 {
+		return ret
+	}
+
+	ret.Middlewares = nil
+	ret.Methods = make([]UbusMethod, len(obj.Methods))
+	for i, method := range obj.Methods {
+		for j := len(obj.Middlewares) - 1; j >= 0; j-- {
+			method.Handler = obj.Middlewares[j](method.Handler)
+		}
+		ret.Methods[i] = method
+	}
+
+	return ret
+}
+
+// apply mw to the given methods only
+func UbusOnly(mw UbusMiddleware, methods ...string) UbusMiddleware {
+	return func(next UbusHandler) UbusHandler {
+		wrapped := mw(next)
+
+		return func(obj string, method string, req *UbusRequestData, msg string) error {
+			if lang.EqualsAny(method, methods...) {
+				return wrapped(obj, method, req, msg)
+			}
+
+			return next(obj, method, req, msg)
+		}
+	}
+}
+
+// turn a panic of the handler into UBUS_STATUS_UNKNOWN_ERROR and log it with
+// its stack, instead of taking down the process from the ubus callback
+func UbusRecoverMiddleware(next UbusHandler) UbusHandler {
+	return func(obj string, method string, req *UbusRequestData, msg string) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.GetLogger().WithFields(map[string]any{
+					"object": obj,
+					"method": method,
+					"stack":  string(debug.Stack()),
+				}).Errorf("ubus handler panic: %v", r)
+
+				err = NewUbusStatusError(UBUS_STATUS_UNKNOWN_ERROR, "panic: %v", r)
+			}
+		}()
+
+		return next(obj, method, req, msg)
+	}
+}
+
+// log each call with its caller, duration and status, failed calls as warnings
+func UbusLogMiddleware(next UbusHandler) UbusHandler {
+	return func(obj string, method string, req *UbusRequestData, msg string) error {
+		start := time.Now()
+		err := next(obj, method, req, msg)
+
+		entry := log.GetLogger().WithFields(map[string]any{
+			"object":  obj,
+			"method":  method,
+			"peer":    req.Peer(),
+			"user":    req.User(),
+			"elapsed": time.Since(start).String(),
+			"status":  UbusStatusOf(err).String(),
+		})
+		if err != nil {
+			entry.WithField("error", err.Error()).Warn("ubus call")
+		} else {
+			entry.Debug("ubus call")
+		}
+
+		return err
+	}
+}
+
+// report the duration and result of each call to observe, e.g. to feed a
+// histogram
+func UbusTimingMiddleware(observe func(obj string, method string, elapsed time.Duration, err error)) UbusMiddleware {
+	return func(next UbusHandler) UbusHandler {
+		return func(obj string, method string, req *UbusRequestData, msg string) error {
+			start := time.Now()
+			err := next(obj, method, req, msg)
+			observe(obj, method, time.Since(start), err)
+
+			return err
+		}
+	}
+}
+
+/*
+Decode the arguments into a new Req and check them with lang.Validate, calls
+that fail are answered with UBUS_STATUS_INVALID_ARGUMENT. for handlers taking
+the raw message, typed methods validate on their own, see AddTypedMethod.
+
+usually limited to one method with UbusOnly.
+*/
+func UbusValidateMiddleware[Req any]() UbusMiddleware {
+	return func(next UbusHandler) UbusHandler {
+		return func(obj string, method string, req *UbusRequestData, msg string) error {
+			var args Req
+			if err := _DecodeUbusArgs(req, reflect.ValueOf(&args).Elem()); err != nil {
+				return err
+			}
+
+			return next(obj, method, req, msg)
+		}
+	}
+}
+
+// token bucket of one method
+type _UbusRateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+Allow each method rate calls per second on average and burst at once, calls
+over the limit are answered with UBUS_STATUS_TIMEOUT, ubus has no status for
+a busy object. the limit is per object method, shared by all callers.
+*/
+func UbusRateLimitMiddleware(rate float64, burst int) UbusMiddleware {
+	var mutex sync.Mutex
+	buckets := make(map[string]*_UbusRateBucket)
+
+	allow := func(key string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		now := time.Now()
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &_UbusRateBucket{tokens: float64(burst), last: now}
+			buckets[key] = bucket
+		}
+
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+		if bucket.tokens > float64(burst) {
+			bucket.tokens = float64(burst)
+		}
+		bucket.last = now
+
+		if bucket.tokens < 1 {
+			return false
+		}
+		bucket.tokens--
+
+		return true
+	}
+
+	return func(next UbusHandler) UbusHandler {
+		return func(obj string, method string, req *UbusRequestData, msg string) error {
+			if !allow(obj + "." + method) {
+				return NewUbusStatusError(UBUS_STATUS_TIMEOUT, "rate limit of %s.%s exceeded", obj, method)
+			}
+
+			return next(obj, method, req, msg)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func TestUbusMiddlewareReconnect(t *testing.T) {
+	b := ubustest.Start(t)
+
+	reconnected := make(chan bool, 1)
+	server, err := openwrt.NewUbusClientWithConfig(context.Background(), &openwrt.UbusConfig{
+		Sock:        b.Sock,
+		Reconnect:   true,
+		Backoff:     10 * time.Millisecond,
+		OnReconnect: func() { reconnected <- true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Free()
+
+	var clientCalls, objectCalls int32
+	counting := func(calls *int32) openwrt.UbusMiddleware {
+		return func(next openwrt.UbusHandler) openwrt.UbusHandler {
+			return func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+				atomic.AddInt32(calls, 1)
+				return next(obj, method, req, msg)
+			}
+		}
+	}
+	server.Use(counting(&clientCalls))
+
+	obj := openwrt.UbusObject{Name: "counted"}
+	obj.AddMethod("get", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		return nil
+	})
+	obj.Use(counting(&objectCalls))
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Disconnect()
+	ubustest.Wait(t, reconnected)
+
+	client := b.NewClient(t)
+	if err := client.Invoke("counted", "get", nil, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// once each, not once more per reconnect
+	if n, m := atomic.LoadInt32(&clientCalls), atomic.LoadInt32(&objectCalls); n != 1 || m != 1 {
+		t.Errorf("expect each middleware called once, got %d and %d", n, m)
+	}
+}
+
+func TestUbusRecoverMiddlewareInvoke(t *testing.T) {
+	b := ubustest.Start(t)
+
+	server := b.NewClient(t)
+	server.Use(openwrt.UbusRecoverMiddleware)
+
+	obj := openwrt.UbusObject{Name: "fragile"}
+	obj.AddMethod("crash", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		panic("boom")
+	})
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := b.NewClient(t)
+	if err := client.Invoke("fragile", "crash", nil, 1000, nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_UNKNOWN_ERROR {
+		t.Fatalf("expected unknown error, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package openwrt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUbusMiddlewareOrder(t *testing.T) {
+	trace := make([]string, 0)
+	tracing := func(name string) UbusMiddleware {
+		return func(next UbusHandler) UbusHandler {
+			return func(obj string, method string, req *UbusRequestData, msg string) error {
+				trace = append(trace, name)
+				return next(obj, method, req, msg)
+			}
+		}
+	}
+
+	obj := UbusObject{Name: "test"}
+	obj.AddMethod("get", func(obj string, method string, req *UbusRequestData, msg string) error {
+		trace = append(trace, "handler")
+		return nil
+	})
+	obj.Use(tracing("client"))
+	obj.Use(tracing("first"), UbusOnly(tracing("only"), "set"), tracing("second"))
+
+	wrapped := obj.wrapped()
+	if status := wrapped.Methods[0].call("test", &UbusRequestData{}, "{}"); status != UBUS_STATUS_OK {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	if got := strings.Join(trace, " "); got != "client first second handler" {
+		t.Errorf("unexpected order %s", got)
+	}
+
+	// the object itself is left alone
+	trace = trace[:0]
+	obj.Methods[0].call("test", &UbusRequestData{}, "{}")
+	if got := strings.Join(trace, " "); got != "handler" {
+		t.Errorf("unexpected order %s", got)
+	}
+}
+
+func TestUbusRecoverMiddleware(t *testing.T) {
+	obj := UbusObject{Name: "test"}
+	obj.AddMethod("crash", func(obj string, method string, req *UbusRequestData, msg string) error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	})
+	obj.Use(UbusRecoverMiddleware)
+
+	wrapped := obj.wrapped()
+	if status := wrapped.Methods[0].call("test", &UbusRequestData{}, "{}"); status != UBUS_STATUS_UNKNOWN_ERROR {
+		t.Errorf("expect unknown error, got %v", status)
+	}
+}
+
+func TestUbusValidateMiddleware(t *testing.T) {
+	var called bool
+	obj := UbusObject{Name: "test"}
+	obj.AddMethod("set", func(obj string, method string, req *UbusRequestData, msg string) error {
+		called = true
+		return nil
+	})
+	obj.Use(UbusOnly(UbusValidateMiddleware[testUbusArgs](), "set"))
+	wrapped := obj.wrapped()
+
+	invoke := func(msg any) UbusStatus {
+		data, _ := BlobmsgMarshal(msg)
+		return wrapped.Methods[0].call("test", &UbusRequestData{data: data}, "")
+	}
+
+	if status := invoke(map[string]any{"port": 80}); status != UBUS_STATUS_INVALID_ARGUMENT || called {
+		t.Errorf("expect invalid argument, got %v", status)
+	}
+	if status := invoke(map[string]any{"name": "lan"}); status != UBUS_STATUS_OK || !called {
+		t.Errorf("expect handler called, got %v", status)
+	}
+}
+
+func TestUbusRateLimitMiddleware(t *testing.T) {
+	obj := UbusObject{Name: "test"}
+	obj.AddMethod("get", func(obj string, method string, req *UbusRequestData, msg string) error {
+		return nil
+	})
+	obj.AddMethod("set", func(obj string, method string, req *UbusRequestData, msg string) error {
+		return nil
+	})
+
+	var timings []string
+	obj.Use(UbusTimingMiddleware(func(obj string, method string, elapsed time.Duration, err error) {
+		timings = append(timings, method+" "+UbusStatusOf(err).String())
+	}))
+	obj.Use(UbusRateLimitMiddleware(0.001, 2))
+	wrapped := obj.wrapped()
+
+	for i, expect := range []UbusStatus{UBUS_STATUS_OK, UBUS_STATUS_OK, UBUS_STATUS_TIMEOUT} {
+		if status := wrapped.Methods[0].call("test", &UbusRequestData{}, "{}"); status != expect {
+			t.Errorf("call %d: expect %v, got %v", i, expect, status)
+		}
+	}
+
+	// each method has its own bucket
+	if status := wrapped.Methods[1].call("test", &UbusRequestData{}, "{}"); status != UBUS_STATUS_OK {
+		t.Errorf("expect set allowed, got %v", status)
+	}
+
+	if len(timings) != 4 || timings[2] != "get "+UBUS_STATUS_TIMEOUT.String() {
+		t.Errorf("unexpected timings %v", timings)
+	}
+}
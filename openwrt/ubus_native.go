@@ -0,0 +1,1068 @@
+//go:build !cgo || ubus_native
+
+package openwrt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// native implementation of the ubus client, talks to ubusd over its unix socket
+// without libubus. selected when building with CGO_ENABLED=0 or -tags ubus_native
+
+// same as ubus_strerror
+func UbusErrorString(code int) string {
+	return UbusStatus(code).String()
+}
+
+// counterpart of ubus_context
+type UbusContext struct {
+	goCtx  context.Context
+	config UbusConfig
+
+	mutex    sync.Mutex
+	conn     net.Conn
+	closed   chan struct{}
+	freed    bool
+	localId  uint32
+	seq      uint16
+	requests map[uint16]*_UbusNativeRequest
+
+	objects     map[string]*_UbusNativeObject
+	objectIds   map[uint32]*_UbusNativeObject
+	listeners   map[string]*_UbusNativeObject
+	subscribers map[*UbusSubscriber]*_UbusNativeObject
+
+	writeMutex sync.Mutex
+	queue      *_UbusDispatchQueue
+
+	fanout _UbusEventFanout
+	// see SetTracer
+	tracer atomic.Pointer[UbusTracer]
+}
+
+// an object registered at ubusd, either with methods, listening for events or
+// subscribed to other objects
+type _UbusNativeObject struct {
+	id          uint32
+	obj         UbusObject
+	pattern     string
+	handler     UbusEventHandler
+	subscribers bool
+	subscriber  *UbusSubscriber
+}
+
+// an outstanding request, completed by its status message
+type _UbusNativeRequest struct {
+	// called by the receiver for every data message
+	onData func(attrs map[int]*BlobAttr) error
+	// called by the receiver with the fd passed along with a reply
+	onFile func(f *os.File)
+	err    error
+	status chan UbusStatus
+}
+
+// counterpart of ubus_request_data
+type UbusRequestData struct {
+	ctx      *UbusContext
+	object   uint32
+	peer     uint32
+	seq      uint16
+	data     []byte
+	deferred bool
+
+	// fds passed along with the call and the status, see ubus_fd.go
+	callerFile *os.File
+	replyFile  *os.File
+
+	// caller and method, see the accessors in ubus.go
+	obj    string
+	method string
+	user   string
+	group  string
+	acl    *UbusAcl
+}
+
+// new connection to ubusd
+func NewUbusContext(reconnect bool) (*UbusContext, error) {
+	return NewUbusContextWithContext(context.Background(), reconnect)
+}
+
+// new connection to ubusd, reconnecting stops when goCtx is done
+func NewUbusContextWithContext(goCtx context.Context, reconnect bool) (*UbusContext, error) {
+	return NewUbusContextWithConfig(goCtx, &UbusConfig{Reconnect: reconnect})
+}
+
+// new connection to ubusd, a nil config for the defaults. Loop makes no
+// difference, see NewUbusLoopContext
+func NewUbusContextWithConfig(goCtx context.Context, config *UbusConfig) (*UbusContext, error) {
+	if err := goCtx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx := &UbusContext{
+		goCtx:       goCtx,
+		config:      _ResolveUbusConfig(config),
+		requests:    make(map[uint16]*_UbusNativeRequest),
+		objects:     make(map[string]*_UbusNativeObject),
+		objectIds:   make(map[uint32]*_UbusNativeObject),
+		listeners:   make(map[string]*_UbusNativeObject),
+		subscribers: make(map[*UbusSubscriber]*_UbusNativeObject),
+		queue:       _NewUbusDispatchQueue(),
+	}
+
+	if err := ctx.connect(); err != nil {
+		return nil, err
+	}
+
+	go ctx.queue.run(ctx.process)
+
+	return ctx, nil
+}
+
+// the native context is safe for concurrent use already, and has no uloop to
+// drive. same as NewUbusContextWithContext
+func NewUbusLoopContext(goCtx context.Context, reconnect bool) (*UbusContext, error) {
+	return NewUbusContextWithConfig(goCtx, &UbusConfig{Reconnect: reconnect, Loop: true})
+}
+
+func (ctx *UbusContext) connect() error {
+	conn, err := net.Dial("unix", ctx.config.Sock)
+	if err != nil {
+		return err
+	}
+
+	hello, err := ReadUbusMessage(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if hello.Type != UBUS_MSG_HELLO {
+		conn.Close()
+		return errors.New("ng: ubus: unexpected message before hello")
+	}
+
+	closed := make(chan struct{})
+
+	ctx.mutex.Lock()
+	ctx.conn = conn
+	ctx.closed = closed
+	ctx.localId = hello.Peer
+	ctx.mutex.Unlock()
+
+	go ctx.receive(conn, closed)
+
+	return nil
+}
+
+func (ctx *UbusContext) receive(conn net.Conn, closed chan struct{}) {
+	for {
+		msg, err := ReadUbusMessage(conn)
+		if err != nil {
+			break
+		}
+
+		ctx.dispatch(msg)
+	}
+
+	conn.Close()
+
+	ctx.mutex.Lock()
+	close(closed)
+	if ctx.conn == conn {
+		ctx.conn = nil
+	}
+	lost := !ctx.freed && ctx.config.Reconnect
+	ctx.mutex.Unlock()
+
+	if lost {
+		ctx.reconnectLoop()
+	}
+}
+
+// same as connection_lost_callback, objects, listeners and subscribers get
+// registered again. subscriptions are by id, which change with a new ubusd,
+// UbusClient renews the ones it made
+func (ctx *UbusContext) reconnectLoop() {
+	if ctx.config.OnDisconnect != nil {
+		ctx.config.OnDisconnect()
+	}
+
+	connected := ctx.config.retry(ctx.goCtx, func() bool {
+		ctx.mutex.Lock()
+		freed := ctx.freed
+		ctx.mutex.Unlock()
+
+		return !freed && ctx.connect() == nil
+	})
+	if !connected {
+		return
+	}
+
+	ctx.mutex.Lock()
+	objects := make([]UbusObject, 0, len(ctx.objects))
+	for _, o := range ctx.objects {
+		objects = append(objects, o.obj)
+	}
+	listeners := make(map[string]UbusEventHandler)
+	for pattern, l := range ctx.listeners {
+		listeners[pattern] = l.handler
+	}
+	subscribers := make([]*UbusSubscriber, 0, len(ctx.subscribers))
+	for s := range ctx.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	ctx.objects = make(map[string]*_UbusNativeObject)
+	ctx.objectIds = make(map[uint32]*_UbusNativeObject)
+	ctx.listeners = make(map[string]*_UbusNativeObject)
+	ctx.subscribers = make(map[*UbusSubscriber]*_UbusNativeObject)
+	ctx.mutex.Unlock()
+
+	for i := range objects {
+		ctx.AddObject(&objects[i])
+	}
+	for pattern, cb := range listeners {
+		ctx.RegisterEvent(pattern, cb)
+	}
+	for _, s := range subscribers {
+		ctx.RegisterSubscriber(s)
+	}
+
+	if ctx.config.OnReconnect != nil {
+		ctx.config.OnReconnect()
+	}
+}
+
+// route a message from ubusd, replies go to their request, calls to the dispatch queue
+func (ctx *UbusContext) dispatch(msg *UbusMessage) {
+	switch msg.Type {
+	case UBUS_MSG_DATA, UBUS_MSG_STATUS:
+		ctx.mutex.Lock()
+		req := ctx.requests[msg.Seq]
+		if req != nil && msg.Type == UBUS_MSG_STATUS {
+			delete(ctx.requests, msg.Seq)
+		}
+		ctx.mutex.Unlock()
+
+		if msg.File != nil {
+			if req != nil && req.onFile != nil {
+				req.onFile(msg.File)
+			} else {
+				msg.File.Close()
+			}
+		}
+
+		if req == nil {
+			return
+		}
+
+		attrs, err := msg.Attrs()
+		if err != nil {
+			req.err = err
+			if msg.Type == UBUS_MSG_STATUS {
+				req.status <- UBUS_STATUS_UNKNOWN_ERROR
+			}
+			return
+		}
+
+		if msg.Type == UBUS_MSG_DATA {
+			if req.onData != nil {
+				if err := req.onData(attrs); err != nil && req.err == nil {
+					req.err = err
+				}
+			}
+			return
+		}
+
+		status := UBUS_STATUS_UNKNOWN_ERROR
+		if attr := attrs[UBUS_ATTR_STATUS]; attr != nil {
+			status = UbusStatus(int32(attr.GetUint32()))
+		}
+		req.status <- status
+	case UBUS_MSG_INVOKE, UBUS_MSG_UNSUBSCRIBE:
+		ctx.queue.push(msg)
+	case UBUS_MSG_NOTIFY:
+		// ubusd tells whether an object of ours has subscribers
+		attrs, err := msg.Attrs()
+		if err != nil || attrs[UBUS_ATTR_OBJID] == nil {
+			return
+		}
+
+		ctx.mutex.Lock()
+		if o := ctx.objectIds[attrs[UBUS_ATTR_OBJID].GetUint32()]; o != nil {
+			o.subscribers = attrs[UBUS_ATTR_ACTIVE] != nil && attrs[UBUS_ATTR_ACTIVE].GetBool()
+		}
+		ctx.mutex.Unlock()
+	default:
+		if msg.File != nil {
+			msg.File.Close()
+		}
+	}
+}
+
+// handle an invoke of one of our objects, called one at a time like uloop does
+func (ctx *UbusContext) process(msg *UbusMessage) {
+	attrs, err := msg.Attrs()
+	if err != nil || attrs[UBUS_ATTR_OBJID] == nil {
+		return
+	}
+
+	if msg.Type == UBUS_MSG_UNSUBSCRIBE {
+		ctx.unsubscribed(attrs)
+		return
+	}
+
+	req := &UbusRequestData{
+		ctx:        ctx,
+		object:     attrs[UBUS_ATTR_OBJID].GetUint32(),
+		peer:       msg.Peer,
+		seq:        msg.Seq,
+		callerFile: msg.File,
+	}
+	// unless the handler took it, like libubus
+	defer func() {
+		if req.callerFile != nil {
+			req.callerFile.Close()
+		}
+		if req.replyFile != nil && !req.deferred {
+			req.replyFile.Close()
+		}
+	}()
+
+	var method string
+	if attr := attrs[UBUS_ATTR_METHOD]; attr != nil {
+		method = attr.GetString()
+	}
+	if attr := attrs[UBUS_ATTR_USER]; attr != nil {
+		req.user = attr.GetString()
+	}
+	if attr := attrs[UBUS_ATTR_GROUP]; attr != nil {
+		req.group = attr.GetString()
+	}
+
+	str := "{}"
+	if attr := attrs[UBUS_ATTR_DATA]; attr != nil {
+		req.data = attr.Data
+		if str, err = FormatBlobmsgJson(attr.Data); err != nil {
+			str = "{}"
+		}
+	}
+
+	ctx.mutex.Lock()
+	o := ctx.objectIds[req.object]
+	ctx.mutex.Unlock()
+
+	status := UBUS_STATUS_OK
+	switch {
+	case o == nil:
+		status = UBUS_STATUS_NOT_FOUND
+	case o.handler != nil:
+		// the method of an event is its id
+		ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_EVENT, Method: method}, str)
+		o.handler(method, str)
+	case o.subscriber != nil:
+		// the method of a notification is its type
+		if o.subscriber.Handler != nil {
+			status = UbusStatusOf(o.subscriber.Handler(method, str))
+		}
+		ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_NOTIFICATION, Method: method, Status: status}, str)
+	default:
+		var m *UbusMethod
+		for i := range o.obj.Methods {
+			if o.obj.Methods[i].Name == method {
+				m = &o.obj.Methods[i]
+				break
+			}
+		}
+
+		if m == nil {
+			status = UBUS_STATUS_METHOD_NOT_FOUND
+			break
+		}
+
+		status = m.call(o.obj.Name, req, str)
+	}
+
+	if attr := attrs[UBUS_ATTR_NO_REPLY]; (attr != nil && attr.GetBool()) || req.deferred {
+		return
+	}
+
+	ctx.sendStatus(req, status)
+}
+
+func (ctx *UbusContext) sendStatus(req *UbusRequestData, status UbusStatus) error {
+	w := NewBlobWriter()
+	w.PutUint32(UBUS_ATTR_STATUS, uint32(status))
+	w.PutUint32(UBUS_ATTR_OBJID, req.object)
+	err := ctx.send(&UbusMessage{Type: UBUS_MSG_STATUS, Seq: req.seq, Peer: req.peer, Data: w.Bytes(), File: req.replyFile})
+	if req.replyFile != nil {
+		req.replyFile.Close()
+		req.replyFile = nil
+	}
+
+	return err
+}
+
+func (ctx *UbusContext) send(msg *UbusMessage) error {
+	ctx.mutex.Lock()
+	conn := ctx.conn
+	ctx.mutex.Unlock()
+
+	if conn == nil {
+		return UBUS_STATUS_CONNECTION_FAILED
+	}
+
+	ctx.writeMutex.Lock()
+	defer ctx.writeMutex.Unlock()
+
+	_, err := msg.WriteTo(conn)
+	return err
+}
+
+// send a request to ubusd and wait for its status. onData is called by the
+// receiving goroutine for each data message, it must not block
+func (ctx *UbusContext) request(goCtx context.Context, typ int, peer uint32, data []byte, onData func(attrs map[int]*BlobAttr) error) error {
+	return ctx.requestFile(goCtx, &UbusMessage{Type: typ, Peer: peer, Data: data}, onData, nil)
+}
+
+// same as request, with the fd of msg sent along and onFile called with the
+// ones of the replies
+func (ctx *UbusContext) requestFile(goCtx context.Context, msg *UbusMessage, onData func(attrs map[int]*BlobAttr) error, onFile func(f *os.File)) error {
+	req := &_UbusNativeRequest{
+		onData: onData,
+		onFile: onFile,
+		status: make(chan UbusStatus, 1),
+	}
+
+	ctx.mutex.Lock()
+	if ctx.conn == nil {
+		ctx.mutex.Unlock()
+		return UBUS_STATUS_CONNECTION_FAILED
+	}
+	for {
+		// ubusd sends notifies with seq 0
+		ctx.seq++
+		if _, ok := ctx.requests[ctx.seq]; !ok && ctx.seq != 0 {
+			break
+		}
+	}
+	seq, closed := ctx.seq, ctx.closed
+	ctx.requests[seq] = req
+	ctx.mutex.Unlock()
+
+	abandon := func() {
+		ctx.mutex.Lock()
+		delete(ctx.requests, seq)
+		ctx.mutex.Unlock()
+	}
+
+	msg.Seq = seq
+	if err := ctx.send(msg); err != nil {
+		abandon()
+		return err
+	}
+
+	var status UbusStatus
+	select {
+	case status = <-req.status:
+	case <-closed:
+		select {
+		case status = <-req.status:
+		default:
+			abandon()
+			return UBUS_STATUS_CONNECTION_FAILED
+		}
+	case <-goCtx.Done():
+		abandon()
+		return goCtx.Err()
+	}
+
+	if status != UBUS_STATUS_OK {
+		return status
+	}
+
+	return req.err
+}
+
+func (ctx *UbusContext) AddULoop() error {
+	// messages are dispatched as soon as they are received
+	return nil
+}
+
+func (ctx *UbusContext) Free() error {
+	ctx.mutex.Lock()
+	ctx.freed = true
+	conn := ctx.conn
+	ctx.mutex.Unlock()
+
+	ctx.queue.close()
+
+	if conn != nil {
+		return conn.Close()
+	}
+
+	return nil
+}
+
+func (ctx *UbusContext) addObject(goCtx context.Context, o *_UbusNativeObject, data []byte) error {
+	return ctx.request(goCtx, UBUS_MSG_ADD_OBJECT, 0, data, func(attrs map[int]*BlobAttr) error {
+		if attr := attrs[UBUS_ATTR_OBJID]; attr != nil {
+			o.id = attr.GetUint32()
+
+			// registered before the status is read, calls may follow right away
+			ctx.mutex.Lock()
+			ctx.objectIds[o.id] = o
+			ctx.mutex.Unlock()
+		}
+		return nil
+	})
+}
+
+func (ctx *UbusContext) removeObject(goCtx context.Context, o *_UbusNativeObject) error {
+	w := NewBlobWriter()
+	w.PutUint32(UBUS_ATTR_OBJID, o.id)
+
+	if err := ctx.request(goCtx, UBUS_MSG_REMOVE_OBJECT, 0, w.Bytes(), nil); err != nil {
+		return err
+	}
+
+	ctx.mutex.Lock()
+	delete(ctx.objectIds, o.id)
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_add_object, the signature is built from the method fields
+func (ctx *UbusContext) AddObject(obj *UbusObject) error {
+	w := NewBlobWriter()
+	w.PutString(UBUS_ATTR_OBJPATH, obj.Name)
+
+	signature := w.Nest(UBUS_ATTR_SIGNATURE)
+	for _, method := range obj.Methods {
+		table := w.OpenTable(method.Name)
+		for _, field := range method.Fields {
+			w.PutMsgInt32(field.Name, int32(field.Type.wireType()))
+		}
+		w.Close(table)
+	}
+	w.Close(signature)
+
+	obj.ctx = ctx
+	o := &_UbusNativeObject{obj: obj.wrapped()}
+	if err := ctx.addObject(context.Background(), o, w.Bytes()); err != nil {
+		return err
+	}
+
+	ctx.mutex.Lock()
+	ctx.objects[obj.Name] = o
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_remove_object
+func (ctx *UbusContext) RemoveObject(name string) error {
+	ctx.mutex.Lock()
+	o, ok := ctx.objects[name]
+	ctx.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := ctx.removeObject(context.Background(), o); err != nil {
+		return err
+	}
+
+	ctx.mutex.Lock()
+	delete(ctx.objects, name)
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_send_reply
+func (ctx *UbusContext) SendReply(req *UbusRequestData, msg any) error {
+	w := NewBlobWriter()
+	w.PutUint32(UBUS_ATTR_OBJID, req.object)
+	data := w.Nest(UBUS_ATTR_DATA)
+	if err := w.AddMessage(msg); err != nil {
+		return err
+	}
+	w.Close(data)
+
+	return ctx.send(&UbusMessage{Type: UBUS_MSG_DATA, Seq: req.seq, Peer: req.peer, Data: w.Bytes()})
+}
+
+// same as ubus_notify with a negative timeout, subscribers don't reply
+func (ctx *UbusContext) Notify(obj string, typ string, msg any) error {
+	ctx.mutex.Lock()
+	o, ok := ctx.objects[obj]
+	ctx.mutex.Unlock()
+
+	if !ok {
+		return UBUS_STATUS_NOT_FOUND
+	}
+
+	w := NewBlobWriter()
+	w.PutUint32(UBUS_ATTR_OBJID, o.id)
+	w.PutString(UBUS_ATTR_METHOD, typ)
+	data := w.Nest(UBUS_ATTR_DATA)
+	if err := w.AddMessage(msg); err != nil {
+		return err
+	}
+	w.Close(data)
+	w.PutUint8(UBUS_ATTR_NO_REPLY, 1)
+
+	err := ctx.send(&UbusMessage{Type: UBUS_MSG_NOTIFY, Data: w.Bytes()})
+	ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_NOTIFY, Object: obj, Id: o.id, Method: typ, Status: UbusStatusOf(err)}, msg)
+
+	return err
+}
+
+// same as ubus_register_subscriber, an anonymous object receiving the
+// notifications. does nothing if s is registered already
+func (ctx *UbusContext) RegisterSubscriber(s *UbusSubscriber) error {
+	ctx.mutex.Lock()
+	_, ok := ctx.subscribers[s]
+	ctx.mutex.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	o := &_UbusNativeObject{subscriber: s}
+	if err := ctx.addObject(context.Background(), o, nil); err != nil {
+		return err
+	}
+
+	ctx.mutex.Lock()
+	ctx.subscribers[s] = o
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_unregister_subscriber, drops all of its subscriptions
+func (ctx *UbusContext) UnregisterSubscriber(s *UbusSubscriber) error {
+	ctx.mutex.Lock()
+	o, ok := ctx.subscribers[s]
+	ctx.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := ctx.removeObject(context.Background(), o); err != nil {
+		return err
+	}
+
+	ctx.mutex.Lock()
+	delete(ctx.subscribers, s)
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_subscribe, s must be registered
+func (ctx *UbusContext) Subscribe(s *UbusSubscriber, id uint32) error {
+	return ctx.subscribe(s, id, UBUS_MSG_SUBSCRIBE)
+}
+
+// same as ubus_unsubscribe
+func (ctx *UbusContext) Unsubscribe(s *UbusSubscriber, id uint32) error {
+	return ctx.subscribe(s, id, UBUS_MSG_UNSUBSCRIBE)
+}
+
+func (ctx *UbusContext) subscribe(s *UbusSubscriber, id uint32, typ int) error {
+	ctx.mutex.Lock()
+	o, ok := ctx.subscribers[s]
+	ctx.mutex.Unlock()
+
+	if !ok {
+		return errors.New("ng: ubus subscriber not registered")
+	}
+
+	w := NewBlobWriter()
+	w.PutUint32(UBUS_ATTR_OBJID, o.id)
+	w.PutUint32(UBUS_ATTR_TARGET, id)
+
+	return ctx.request(context.Background(), typ, 0, w.Bytes(), nil)
+}
+
+// ubusd dropped a subscription, the object subscribed to is gone
+func (ctx *UbusContext) unsubscribed(attrs map[int]*BlobAttr) {
+	if attrs[UBUS_ATTR_TARGET] == nil {
+		return
+	}
+	id := attrs[UBUS_ATTR_TARGET].GetUint32()
+
+	ctx.mutex.Lock()
+	o := ctx.objectIds[attrs[UBUS_ATTR_OBJID].GetUint32()]
+	ctx.mutex.Unlock()
+
+	if o != nil && o.subscriber != nil && o.subscriber.RemoveHandler != nil {
+		o.subscriber.RemoveHandler(id)
+	}
+}
+
+// a request answered after its handler returned, see UbusRequestData.Defer
+type UbusDeferredRequest struct {
+	req   UbusRequestData
+	mutex sync.Mutex
+	done  bool
+}
+
+// same as ubus_defer_request. must be called by the handler, which may then
+// return and leave the reply to another goroutine. the request stays open until
+// Complete is called
+func (req *UbusRequestData) Defer() *UbusDeferredRequest {
+	req.deferred = true
+	return &UbusDeferredRequest{req: *req}
+}
+
+// same as ubus_request_get_caller_fd, the file sent along with the call or nil.
+// the handler owns it from then on, it's closed once the handler returns
+// otherwise
+func (req *UbusRequestData) CallerFile() *os.File {
+	f := req.callerFile
+	req.callerFile = nil
+	return f
+}
+
+// same as ubus_request_set_fd, f is sent along with the status of the request.
+// call before Defer for a deferred request. a copy is sent, the handler keeps f
+func (req *UbusRequestData) SetReplyFile(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+
+	if req.replyFile != nil {
+		req.replyFile.Close()
+	}
+	req.replyFile = os.NewFile(uintptr(fd), "ubus")
+	return nil
+}
+
+func (d *UbusDeferredRequest) Reply(msg any) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done {
+		return errors.New("ng: deferred request already completed")
+	}
+
+	return d.req.ctx.SendReply(&d.req, msg)
+}
+
+// same as ubus_complete_deferred_request
+func (d *UbusDeferredRequest) Complete(status UbusStatus) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done {
+		return errors.New("ng: deferred request already completed")
+	}
+	d.done = true
+
+	return d.req.ctx.sendStatus(&d.req, status)
+}
+
+// same as ubus_lookup_id
+func (ctx *UbusContext) LookupId(path string) (uint32, error) {
+	return ctx.LookupIdContext(context.Background(), path)
+}
+
+func (ctx *UbusContext) LookupIdContext(goCtx context.Context, path string) (uint32, error) {
+	w := NewBlobWriter()
+	w.PutString(UBUS_ATTR_OBJPATH, path)
+
+	var id uint32
+	err := ctx.request(goCtx, UBUS_MSG_LOOKUP, 0, w.Bytes(), func(attrs map[int]*BlobAttr) error {
+		if attr := attrs[UBUS_ATTR_OBJID]; attr != nil {
+			id = attr.GetUint32()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	_TracerOf(ctx).lookup(path, id)
+
+	return id, nil
+}
+
+// same as ubus_lookup, a blank pattern for all objects
+func (ctx *UbusContext) Lookup(pattern string) ([]UbusObjectData, error) {
+	return ctx.LookupContext(context.Background(), pattern)
+}
+
+func (ctx *UbusContext) LookupContext(goCtx context.Context, pattern string) ([]UbusObjectData, error) {
+	w := NewBlobWriter()
+	if pattern != "" {
+		w.PutString(UBUS_ATTR_OBJPATH, pattern)
+	}
+
+	objects := make([]UbusObjectData, 0)
+	err := ctx.request(goCtx, UBUS_MSG_LOOKUP, 0, w.Bytes(), func(attrs map[int]*BlobAttr) error {
+		if attrs[UBUS_ATTR_OBJID] == nil || attrs[UBUS_ATTR_OBJPATH] == nil {
+			return nil
+		}
+
+		object := UbusObjectData{
+			Id:   attrs[UBUS_ATTR_OBJID].GetUint32(),
+			Path: attrs[UBUS_ATTR_OBJPATH].GetString(),
+		}
+		if attr := attrs[UBUS_ATTR_OBJTYPE]; attr != nil {
+			object.TypeId = attr.GetUint32()
+		}
+		if attr := attrs[UBUS_ATTR_SIGNATURE]; attr != nil {
+			signature, err := _ParseUbusSignature(attr.Data)
+			if err != nil {
+				return err
+			}
+			object.Signature = signature
+		}
+
+		objects = append(objects, object)
+		_TracerOf(ctx).lookup(object.Path, object.Id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// same as ubus_invoke, timeout in ms, 0 waits forever. cb is called for every
+// data message of the reply, in order
+func (ctx *UbusContext) Invoke(id uint32, method string, param any, timeout int, cb UbusDataHandler) error {
+	return ctx.invoke(context.Background(), id, method, param, timeout, nil, cb)
+}
+
+// the deadline of goCtx is the invoke timeout (DEFAULT_INVOKE_TIMEOUT without one)
+func (ctx *UbusContext) InvokeContext(goCtx context.Context, id uint32, method string, param any, cb UbusDataHandler) error {
+	timeout, err := _UbusInvokeTimeout(goCtx)
+	if err != nil {
+		return err
+	}
+
+	return ctx.invoke(goCtx, id, method, param, timeout, nil, cb)
+}
+
+// timeout of an invoke made with goCtx, the request is bound to its deadline
+// already
+func _UbusInvokeTimeout(goCtx context.Context) (int, error) {
+	deadline, ok := goCtx.Deadline()
+	if !ok {
+		return DEFAULT_INVOKE_TIMEOUT, nil
+	}
+	if time.Until(deadline) <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+
+	return 0, nil
+}
+
+func (ctx *UbusContext) invoke(goCtx context.Context, id uint32, method string, param any, timeout int, opts *UbusInvokeOptions, cb UbusDataHandler) (err error) {
+	cb, done := ctx.traceInvoke(id, method, param, cb)
+	defer func() { done(err) }()
+
+	// the callback runs in the caller once the request is complete
+	replies := make([]string, 0, 1)
+	err = ctx.invokeEach(goCtx, id, method, param, timeout, opts, func(msg string) error {
+		replies = append(replies, msg)
+		return nil
+	})
+	if err != nil || cb == nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		if err = cb(reply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// invoke without tracing, onReply is called by the receiver for every data
+// message and must not block
+func (ctx *UbusContext) invokeEach(goCtx context.Context, id uint32, method string, param any, timeout int, opts *UbusInvokeOptions, onReply UbusDataHandler) error {
+	w := NewBlobWriter()
+	if err := w.AddMessage(param); err != nil {
+		return err
+	}
+
+	return ctx.invokeBlob(goCtx, id, method, w.Bytes(), timeout, opts, func(data []byte) error {
+		str, err := FormatBlobmsgJson(data)
+		if err != nil {
+			return err
+		}
+
+		return onReply(str)
+	})
+}
+
+func (ctx *UbusContext) invokeBlob(goCtx context.Context, id uint32, method string, data []byte, timeout int, opts *UbusInvokeOptions, onData func(data []byte) error) error {
+	w := NewBlobWriter()
+	w.PutUint32(UBUS_ATTR_OBJID, id)
+	w.PutString(UBUS_ATTR_METHOD, method)
+	w.Put(UBUS_ATTR_DATA, data)
+
+	reqCtx := goCtx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(goCtx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	msg := &UbusMessage{Type: UBUS_MSG_INVOKE, Peer: id, Data: w.Bytes()}
+	var onFile func(f *os.File)
+	if opts != nil {
+		msg.File, onFile = opts.File, opts.OnFile
+	}
+
+	err := ctx.requestFile(reqCtx, msg, func(attrs map[int]*BlobAttr) error {
+		if attr := attrs[UBUS_ATTR_DATA]; attr != nil && onData != nil {
+			return onData(attr.Data)
+		}
+		return nil
+	}, onFile)
+
+	if errors.Is(err, context.DeadlineExceeded) && goCtx.Err() == nil {
+		return UBUS_STATUS_TIMEOUT
+	}
+
+	return err
+}
+
+// same as ubus_register_event_handler, ubusd matches the pattern
+func (ctx *UbusContext) RegisterEvent(pattern string, cb UbusEventHandler) error {
+	// a pattern has one listener, registering again replaces the handler
+	if err := ctx.UnregisterEvent(pattern); err != nil {
+		return err
+	}
+
+	o := &_UbusNativeObject{pattern: pattern, handler: cb}
+	if err := ctx.addObject(context.Background(), o, nil); err != nil {
+		return err
+	}
+
+	w := NewBlobWriter()
+	w.PutMsgInt32("object", int32(o.id))
+	w.PutMsgString("pattern", pattern)
+
+	if err := ctx.invokeBlob(context.Background(), UBUS_SYSTEM_OBJECT_EVENT, "register", w.Bytes(), 0, nil, nil); err != nil {
+		ctx.removeObject(context.Background(), o)
+		return err
+	}
+
+	ctx.mutex.Lock()
+	ctx.listeners[pattern] = o
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_unregister_event_handler
+func (ctx *UbusContext) UnregisterEvent(pattern string) error {
+	ctx.mutex.Lock()
+	o, ok := ctx.listeners[pattern]
+	ctx.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := ctx.removeObject(context.Background(), o); err != nil {
+		return err
+	}
+
+	ctx.mutex.Lock()
+	delete(ctx.listeners, pattern)
+	ctx.mutex.Unlock()
+
+	return nil
+}
+
+// same as ubus_send_event
+func (ctx *UbusContext) SendEvent(id string, msg any) error {
+	return ctx.SendEventContext(context.Background(), id, msg)
+}
+
+func (ctx *UbusContext) SendEventContext(goCtx context.Context, id string, msg any) error {
+	w := NewBlobWriter()
+	w.PutMsgString("id", id)
+	table := w.OpenTable("data")
+	if err := w.AddMessage(msg); err != nil {
+		return err
+	}
+	w.Close(table)
+
+	err := ctx.invokeBlob(goCtx, UBUS_SYSTEM_OBJECT_EVENT, "send", w.Bytes(), 0, nil, nil)
+	ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_SEND_EVENT, Method: id, Status: UbusStatusOf(err)}, msg)
+
+	return err
+}
+
+// unbounded fifo of invokes handled by one goroutine, so a slow handler never
+// blocks the receiver and replies to requests made from handlers get through
+type _UbusDispatchQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	messages []*UbusMessage
+	closed   bool
+}
+
+func _NewUbusDispatchQueue() *_UbusDispatchQueue {
+	queue := &_UbusDispatchQueue{}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+func (queue *_UbusDispatchQueue) push(msg *UbusMessage) {
+	queue.mutex.Lock()
+	queue.messages = append(queue.messages, msg)
+	queue.mutex.Unlock()
+	queue.cond.Signal()
+}
+
+func (queue *_UbusDispatchQueue) close() {
+	queue.mutex.Lock()
+	queue.closed = true
+	queue.mutex.Unlock()
+	queue.cond.Broadcast()
+}
+
+func (queue *_UbusDispatchQueue) run(handle func(msg *UbusMessage)) {
+	for {
+		queue.mutex.Lock()
+		for len(queue.messages) == 0 && !queue.closed {
+			queue.cond.Wait()
+		}
+		if queue.closed {
+			queue.mutex.Unlock()
+			return
+		}
+		msg := queue.messages[0]
+		queue.messages = queue.messages[1:]
+		queue.mutex.Unlock()
+
+		handle(msg)
+	}
+}
@@ -0,0 +1,186 @@
+package openwrt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ubusd unix socket protocol, see ubusmsg.h
+
+// enum ubus_msg_type
+const (
+	UBUS_MSG_HELLO = iota
+	UBUS_MSG_STATUS
+	UBUS_MSG_DATA
+	UBUS_MSG_PING
+	UBUS_MSG_LOOKUP
+	UBUS_MSG_INVOKE
+	UBUS_MSG_ADD_OBJECT
+	UBUS_MSG_REMOVE_OBJECT
+	UBUS_MSG_SUBSCRIBE
+	UBUS_MSG_UNSUBSCRIBE
+	UBUS_MSG_NOTIFY
+	UBUS_MSG_MONITOR
+)
+
+// enum ubus_msg_attr
+const (
+	UBUS_ATTR_UNSPEC = iota
+	UBUS_ATTR_STATUS
+	UBUS_ATTR_OBJPATH
+	UBUS_ATTR_OBJID
+	UBUS_ATTR_METHOD
+	UBUS_ATTR_OBJTYPE
+	UBUS_ATTR_SIGNATURE
+	UBUS_ATTR_DATA
+	UBUS_ATTR_TARGET
+	UBUS_ATTR_ACTIVE
+	UBUS_ATTR_NO_REPLY
+	UBUS_ATTR_SUBSCRIBERS
+	UBUS_ATTR_USER
+	UBUS_ATTR_GROUP
+)
+
+const (
+	UBUS_SYSTEM_OBJECT_EVENT = 1
+	UBUS_SYSTEM_OBJECT_ACL   = 2
+
+	UBUS_MSG_HDR_LEN = 8
+	UBUS_MAX_MSGLEN  = 1048576
+)
+
+// struct ubus_msghdr followed by the blob of ubus attributes
+type UbusMessage struct {
+	Type int
+	Seq  uint16
+	Peer uint32
+	// packed UBUS_ATTR_* attributes
+	Data []byte
+	// fd passed along with the message over a unix socket, nil for none
+	File *os.File
+}
+
+// the fd passed along with the message is read too when r is a unix socket
+func ReadUbusMessage(r io.Reader) (*UbusMessage, error) {
+	var files []*os.File
+	if conn, ok := r.(*net.UnixConn); ok {
+		r = &_UnixRightsReader{conn: conn, files: &files}
+	}
+
+	msg, err := readUbusMessage(r)
+	if err != nil || len(files) == 0 {
+		for _, f := range files {
+			f.Close()
+		}
+		return msg, err
+	}
+
+	// one fd per message, like libubus
+	msg.File = files[0]
+	for _, f := range files[1:] {
+		f.Close()
+	}
+
+	return msg, nil
+}
+
+func readUbusMessage(r io.Reader) (*UbusMessage, error) {
+	hdr := make([]byte, UBUS_MSG_HDR_LEN+blobAttrHdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(hdr[UBUS_MSG_HDR_LEN:]) & blobAttrLenMask)
+	if size < blobAttrHdrLen || size > UBUS_MAX_MSGLEN {
+		return nil, errors.New("ng: invalid ubus message length")
+	}
+
+	msg := &UbusMessage{
+		Type: int(hdr[1]),
+		Seq:  binary.BigEndian.Uint16(hdr[2:]),
+		Peer: binary.BigEndian.Uint32(hdr[4:]),
+		Data: make([]byte, size-blobAttrHdrLen),
+	}
+
+	if _, err := io.ReadFull(r, msg.Data); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (msg *UbusMessage) Bytes() []byte {
+	buf := make([]byte, UBUS_MSG_HDR_LEN, UBUS_MSG_HDR_LEN+blobAttrHdrLen+len(msg.Data))
+	buf[1] = uint8(msg.Type)
+	binary.BigEndian.PutUint16(buf[2:], msg.Seq)
+	binary.BigEndian.PutUint32(buf[4:], msg.Peer)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(blobAttrHdrLen+len(msg.Data))&blobAttrLenMask)
+	return append(buf, msg.Data...)
+}
+
+// File is sent along with the message when w is a unix socket, and stays open
+func (msg *UbusMessage) WriteTo(w io.Writer) (int64, error) {
+	conn, ok := w.(*net.UnixConn)
+	if msg.File == nil || !ok {
+		n, err := w.Write(msg.Bytes())
+		return int64(n), err
+	}
+
+	buf := msg.Bytes()
+	n, _, err := conn.WriteMsgUnix(buf, syscall.UnixRights(int(msg.File.Fd())), nil)
+	if err == nil && n < len(buf) {
+		// the fd went with the first part
+		var m int
+		m, err = conn.Write(buf[n:])
+		n += m
+	}
+
+	return int64(n), err
+}
+
+// reads the fds passed along with the data as well
+type _UnixRightsReader struct {
+	conn  *net.UnixConn
+	files *[]*os.File
+}
+
+func (r *_UnixRightsReader) Read(p []byte) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	n, oobn, _, _, err := r.conn.ReadMsgUnix(p, oob)
+	if oobn > 0 {
+		if cmsgs, perr := syscall.ParseSocketControlMessage(oob[:oobn]); perr == nil {
+			for i := range cmsgs {
+				fds, _ := syscall.ParseUnixRights(&cmsgs[i])
+				for _, fd := range fds {
+					*r.files = append(*r.files, os.NewFile(uintptr(fd), "ubus"))
+				}
+			}
+		}
+	}
+
+	// unlike Read, ReadMsgUnix reports a closed stream as nothing read
+	if n == 0 && err == nil && len(p) > 0 {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// the ubus attributes of the message by id
+func (msg *UbusMessage) Attrs() (map[int]*BlobAttr, error) {
+	attrs, err := ParseBlobAttrs(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int]*BlobAttr, len(attrs))
+	for i := range attrs {
+		result[attrs[i].Id] = &attrs[i]
+	}
+
+	return result, nil
+}
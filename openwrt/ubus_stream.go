@@ -0,0 +1,127 @@
+package openwrt
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hzwesoft-github/underscore/json"
+)
+
+/*
+The data messages of an invoke as they arrive, for methods replying more than
+once or streaming a result. like bufio.Scanner:
+
+	stream := client.Stream(goCtx, "log", "read", nil)
+	for stream.Next() {
+		fmt.Println(stream.Reply())
+	}
+	if err := stream.Err(); err != nil {
+		...
+	}
+
+the messages are buffered until read. canceling goCtx ends the request early
+with the native client only, libubus can't abandon a request once sent: it goes
+on until it completes or the deadline of goCtx passes.
+*/
+type UbusStream struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	replies []string
+	reply   string
+	done    bool
+	err     error
+}
+
+func _NewUbusStream() *UbusStream {
+	s := &UbusStream{}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// wait for the next data message, false once the request is complete
+func (s *UbusStream) Next() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.replies) == 0 && !s.done {
+		s.cond.Wait()
+	}
+
+	if len(s.replies) == 0 {
+		return false
+	}
+
+	s.reply = s.replies[0]
+	s.replies = s.replies[1:]
+	return true
+}
+
+// the data message read by Next as json
+func (s *UbusStream) Reply() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.reply
+}
+
+// decode the data message read by Next into v
+func (s *UbusStream) Decode(v any) error {
+	return json.UnmarshalFromString(s.Reply(), v)
+}
+
+// error of the request once Next returned false, nil if it succeeded
+func (s *UbusStream) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+func (s *UbusStream) push(msg string) error {
+	s.mutex.Lock()
+	s.replies = append(s.replies, msg)
+	s.mutex.Unlock()
+
+	s.cond.Signal()
+	return nil
+}
+
+func (s *UbusStream) finish(err error) {
+	s.mutex.Lock()
+	s.done, s.err = true, err
+	s.mutex.Unlock()
+
+	s.cond.Broadcast()
+}
+
+// invoke method of the object id and read its data messages from the returned
+// stream. the deadline of goCtx is the invoke timeout, see InvokeContext
+func (ctx *UbusContext) Stream(goCtx context.Context, id uint32, method string, param any) *UbusStream {
+	s := _NewUbusStream()
+
+	timeout, err := _UbusInvokeTimeout(goCtx)
+	if err != nil {
+		s.finish(err)
+		return s
+	}
+
+	onReply, done := ctx.traceInvoke(id, method, param, s.push)
+	go func() {
+		err := ctx.invokeEach(goCtx, id, method, param, timeout, nil, onReply)
+		done(err)
+		s.finish(err)
+	}()
+
+	return s
+}
+
+func (client *UbusClient) Stream(goCtx context.Context, obj string, method string, param any) *UbusStream {
+	id, err := client.Context.LookupIdContext(goCtx, obj)
+	if err != nil {
+		s := _NewUbusStream()
+		s.finish(err)
+		return s
+	}
+
+	return client.Context.Stream(goCtx, id, method, param)
+}
@@ -0,0 +1,63 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func TestUbusStream(t *testing.T) {
+	b := ubustest.Start(t)
+
+	server := b.NewClient(t)
+	obj := openwrt.UbusObject{Name: "log"}
+	obj.AddMethod("read", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		for i := 1; i <= 3; i++ {
+			if err := req.Reply(map[string]any{"line": i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := b.NewClient(t)
+	stream := client.Stream(context.Background(), "log", "read", nil)
+
+	lines := make([]int, 0)
+	for stream.Next() {
+		var reply struct{ Line int }
+		if err := stream.Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, reply.Line)
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[0] != 1 || lines[2] != 3 {
+		t.Errorf("unexpected lines %v", lines)
+	}
+
+	// every data message reaches the callback of an invoke too
+	replies := make([]string, 0)
+	err := client.Invoke("log", "read", nil, 1000, func(msg string) error {
+		replies = append(replies, msg)
+		return nil
+	})
+	if err != nil || len(replies) != 3 || replies[2] != `{"line":3}` {
+		t.Errorf("unexpected replies %v, %v", replies, err)
+	}
+
+	stream = client.Stream(context.Background(), "missing", "read", nil)
+	if stream.Next() || openwrt.UbusStatusOf(stream.Err()) != openwrt.UBUS_STATUS_NOT_FOUND {
+		t.Errorf("expect not found, got %v", stream.Err())
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func TestUbusAclInvoke(t *testing.T) {
+	b := ubustest.Start(t)
+	b.User, b.Group = "guest", "users"
+
+	callers := make(chan string, 1)
+	server := b.NewClient(t)
+	obj := openwrt.UbusObject{Name: "acl"}
+	handler := func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		callers <- req.User() + "/" + req.Group() + " " + req.ObjectName() + "." + req.Method()
+		return nil
+	}
+	obj.AddMethod("get", openwrt.UbusAclMiddleware(handler))
+	obj.AddMethod("set", openwrt.UbusAclMiddleware(handler))
+	obj.SetMethodAcl("set", &openwrt.UbusAcl{Users: []string{"root"}})
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := b.NewClient(t)
+	if err := client.Invoke("acl", "get", nil, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := ubustest.Wait(t, callers); got != "guest/users acl.get" {
+		t.Fatalf("unexpected caller %s", got)
+	}
+
+	if err := client.Invoke("acl", "set", nil, 1000, nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_PERMISSION_DENIED {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+package openwrt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/json"
+	"github.com/hzwesoft-github/underscore/log"
+)
+
+// kinds of trace records
+const (
+	// a call made by the context, with its reply
+	UBUS_TRACE_INVOKE = "invoke"
+	// a call handled by a method of an object of the context
+	UBUS_TRACE_HANDLE     = "handle"
+	UBUS_TRACE_SEND_EVENT = "send_event"
+	UBUS_TRACE_EVENT      = "event"
+	// a notification sent to the subscribers of an object of the context
+	UBUS_TRACE_NOTIFY = "notify"
+	// a notification received by a subscriber
+	UBUS_TRACE_NOTIFICATION = "notification"
+)
+
+const (
+	// longest payload in the log
+	DEFAULT_TRACE_PAYLOAD = 256
+)
+
+// one traced message, a line of the trace file
+type UbusTraceRecord struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// path of the object, empty if the context never looked it up
+	Object string `json:"object,omitempty"`
+	Id     uint32 `json:"id,omitempty"`
+	// method of a call, id of an event or type of a notification
+	Method string `json:"method,omitempty"`
+	// client id of the caller of a handled call
+	Peer uint32 `json:"peer,omitempty"`
+	// duration of a call, 0 for the others
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+	Status  UbusStatus    `json:"status"`
+	// message as json, redacted
+	Payload string `json:"payload,omitempty"`
+	// first reply of an invoke
+	Reply string `json:"reply,omitempty"`
+}
+
+/*
+Record the messages of a context, see UbusContext.SetTracer. each record is
+logged at debug level with its payloads truncated, and written to Writer as a
+line of json with its payloads whole, for ReplayUbusTrace.
+*/
+type UbusTracer struct {
+	// log the records through the log package
+	Log bool
+	// write the records to, e.g. a file
+	Writer io.Writer
+	// longest payload in the log, DEFAULT_TRACE_PAYLOAD when 0, negative for none
+	MaxPayload int
+	// keys of json objects whose values are replaced by "***" in payloads, e.g.
+	// password. compared ignoring case
+	Redact []string
+
+	mutex sync.Mutex
+	// paths of the objects looked up, by id
+	paths map[uint32]string
+}
+
+// trace the messages of the context with t, nil stops tracing
+func (ctx *UbusContext) SetTracer(t *UbusTracer) {
+	ctx.tracer.Store(t)
+}
+
+func _TracerOf(ctx *UbusContext) *UbusTracer {
+	if ctx == nil {
+		return nil
+	}
+
+	return ctx.tracer.Load()
+}
+
+// remember the path of id for the records of later invokes
+func (t *UbusTracer) lookup(path string, id uint32) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.paths == nil {
+		t.paths = make(map[uint32]string)
+	}
+	t.paths[id] = path
+}
+
+// record a message, payload is a json string or a value to encode as such
+func (t *UbusTracer) record(rec *UbusTraceRecord, payload any) {
+	if t == nil {
+		return
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Payload = t.format(payload)
+	rec.Reply = t.format(rec.Reply)
+
+	t.mutex.Lock()
+	if rec.Object == "" && rec.Id != 0 {
+		rec.Object = t.paths[rec.Id]
+	}
+	t.mutex.Unlock()
+
+	if t.Log && log.IsDebugEnabled() {
+		log.GetLogger().WithFields(map[string]any{
+			"kind":    rec.Kind,
+			"object":  rec.Object,
+			"id":      rec.Id,
+			"method":  rec.Method,
+			"peer":    rec.Peer,
+			"elapsed": rec.Elapsed.String(),
+			"status":  rec.Status.String(),
+			"payload": t.truncate(rec.Payload),
+			"reply":   t.truncate(rec.Reply),
+		}).Debug("ubus trace")
+	}
+
+	if t.Writer != nil {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+
+		t.mutex.Lock()
+		t.Writer.Write(append(line, '\n'))
+		t.mutex.Unlock()
+	}
+}
+
+// payload as redacted json
+func (t *UbusTracer) format(payload any) string {
+	var str string
+	switch v := payload.(type) {
+	case nil:
+		return ""
+	case string:
+		str = v
+	default:
+		var err error
+		if str, err = json.MarshalToString(v); err != nil {
+			return ""
+		}
+	}
+
+	if len(t.Redact) == 0 || str == "" {
+		return str
+	}
+
+	var value any
+	if err := json.UnmarshalFromString(str, &value); err != nil {
+		return str
+	}
+	if ret, err := json.MarshalToString(t.redact(value)); err == nil {
+		return ret
+	}
+
+	return str
+}
+
+func (t *UbusTracer) redact(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, member := range v {
+			redacted := false
+			for _, name := range t.Redact {
+				if strings.EqualFold(key, name) {
+					redacted = true
+					break
+				}
+			}
+
+			if redacted {
+				v[key] = "***"
+			} else {
+				v[key] = t.redact(member)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = t.redact(v[i])
+		}
+	}
+
+	return value
+}
+
+func (t *UbusTracer) truncate(payload string) string {
+	max := t.MaxPayload
+	if max == 0 {
+		max = DEFAULT_TRACE_PAYLOAD
+	}
+	if max < 0 {
+		return ""
+	}
+
+	if len(payload) > max {
+		return payload[:max] + "..."
+	}
+
+	return payload
+}
+
+// trace an invoke of the context, the returned callback records the first
+// reply and done records the call once it's over
+func (ctx *UbusContext) traceInvoke(id uint32, method string, param any, cb UbusDataHandler) (UbusDataHandler, func(err error)) {
+	t := _TracerOf(ctx)
+	if t == nil {
+		return cb, func(error) {}
+	}
+
+	rec := &UbusTraceRecord{Time: time.Now(), Kind: UBUS_TRACE_INVOKE, Id: id, Method: method}
+	traced := func(msg string) error {
+		if rec.Reply == "" {
+			rec.Reply = msg
+		}
+		if cb != nil {
+			return cb(msg)
+		}
+		return nil
+	}
+
+	return traced, func(err error) {
+		rec.Elapsed = time.Since(rec.Time)
+		rec.Status = UbusStatusOf(err)
+		t.record(rec, param)
+	}
+}
+
+// read the records written by a tracer
+func ReadUbusTrace(r io.Reader) ([]UbusTraceRecord, error) {
+	records := make([]UbusTraceRecord, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), UBUS_MAX_MSGLEN*2)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var rec UbusTraceRecord
+		if err := json.UnmarshalFromString(line, &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+/*
+Make the invokes and send the events of records again, in order and without
+their original timing. the other records are skipped.
+
+an invoke goes to Object, or Id if the path is unknown. it's an error when it
+ends with another status than recorded, replay stops there.
+*/
+func ReplayUbusTrace(goCtx context.Context, client *UbusClient, records []UbusTraceRecord) error {
+	for i := range records {
+		rec := &records[i]
+
+		var err error
+		switch rec.Kind {
+		case UBUS_TRACE_INVOKE:
+			id := rec.Id
+			if rec.Object != "" {
+				if id, err = client.Context.LookupIdContext(goCtx, rec.Object); err != nil {
+					break
+				}
+			}
+			err = client.Context.InvokeContext(goCtx, id, rec.Method, _TracePayload(rec.Payload), nil)
+		case UBUS_TRACE_SEND_EVENT:
+			err = client.Context.SendEventContext(goCtx, rec.Method, _TracePayload(rec.Payload))
+		default:
+			continue
+		}
+
+		if status := UbusStatusOf(err); status != rec.Status {
+			return fmt.Errorf("ng: ubus replay of record %d, %s %s: expect %v, got %v", i, rec.Object, rec.Method, rec.Status, status)
+		}
+	}
+
+	return nil
+}
+
+func _TracePayload(payload string) string {
+	if payload == "" {
+		return "{}"
+	}
+
+	return payload
+}
+
+// record a message of the context, if traced
+func (ctx *UbusContext) trace(rec *UbusTraceRecord, payload any) {
+	_TracerOf(ctx).record(rec, payload)
+}
+
+// arguments of a handled call as json
+func _TraceArgs(req *UbusRequestData, msg string) string {
+	if msg != "" || len(req.data) == 0 {
+		return msg
+	}
+
+	if str, err := FormatBlobmsgJson(req.data); err == nil {
+		return str
+	}
+
+	return ""
+}
@@ -0,0 +1,69 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+func TestUbusTraceReplay(t *testing.T) {
+	b := ubustest.Start(t)
+	system := b.AddObject("system").Reply("board", map[string]any{"model": "test"}).Fail("reboot", openwrt.UBUS_STATUS_PERMISSION_DENIED)
+
+	var buf bytes.Buffer
+	client := b.NewClient(t)
+	client.Context.SetTracer(&openwrt.UbusTracer{Writer: &buf, Redact: []string{"password"}})
+
+	if _, err := openwrt.Call[map[string]any](client, "system", "board", map[string]any{"password": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openwrt.Call[map[string]any](client, "system", "reboot", nil); err == nil {
+		t.Fatal("expect reboot denied")
+	}
+	if err := client.SendEvent("test.event", map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	trace := buf.String()
+	records, err := openwrt.ReadUbusTrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expect 3 records, got %s", trace)
+	}
+
+	rec := records[0]
+	if rec.Kind != openwrt.UBUS_TRACE_INVOKE || rec.Object != "system" || rec.Method != "board" || rec.Status != openwrt.UBUS_STATUS_OK {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.Payload != `{"password":"***"}` || rec.Reply != `{"model":"test"}` {
+		t.Errorf("unexpected payloads %s %s", rec.Payload, rec.Reply)
+	}
+	if rec = records[1]; rec.Status != openwrt.UBUS_STATUS_PERMISSION_DENIED {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec = records[2]; rec.Kind != openwrt.UBUS_TRACE_SEND_EVENT || rec.Method != "test.event" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+
+	// replayed by another client, with the redacted arguments
+	if err := openwrt.ReplayUbusTrace(context.Background(), b.NewClient(t), records); err != nil {
+		t.Fatal(err)
+	}
+	calls := system.CallsTo("board")
+	if len(calls) != 2 || calls[1].Args["password"] != "***" {
+		t.Errorf("unexpected calls %+v", calls)
+	}
+
+	system.Fail("board", openwrt.UBUS_STATUS_UNKNOWN_ERROR)
+	if err := openwrt.ReplayUbusTrace(context.Background(), b.NewClient(t), records); err == nil {
+		t.Error("expect replay to fail on another status")
+	}
+}
@@ -0,0 +1,64 @@
+package openwrt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUbusTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := &UbusTracer{Writer: &buf, MaxPayload: 8, Redact: []string{"Password"}}
+	ctx := &UbusContext{}
+	ctx.SetTracer(tracer)
+
+	obj := UbusObject{Name: "test"}
+	obj.AddMethod("login", func(obj string, method string, req *UbusRequestData, msg string) error {
+		return UBUS_STATUS_PERMISSION_DENIED
+	})
+	req := &UbusRequestData{ctx: ctx, peer: 7}
+	obj.Methods[0].call("test", req, `{"user":"root","auth":{"password":"secret"}}`)
+
+	tracer.lookup("network", 42)
+	ctx.trace(&UbusTraceRecord{Kind: UBUS_TRACE_NOTIFY, Id: 42, Method: "up"}, map[string]any{"passWord": []any{1}})
+
+	records, err := ReadUbusTrace(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expect 2 records, got %d", len(records))
+	}
+
+	rec := records[0]
+	if rec.Kind != UBUS_TRACE_HANDLE || rec.Object != "test" || rec.Method != "login" || rec.Peer != 7 || rec.Status != UBUS_STATUS_PERMISSION_DENIED {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.Payload != `{"auth":{"password":"***"},"user":"root"}` {
+		t.Errorf("unexpected payload %s", rec.Payload)
+	}
+
+	if rec = records[1]; rec.Object != "network" || rec.Payload != `{"passWord":"***"}` {
+		t.Errorf("unexpected record %+v", rec)
+	}
+
+	// only the log is truncated
+	if got := tracer.truncate(records[0].Payload); got != `{"auth":...` {
+		t.Errorf("unexpected truncation %s", got)
+	}
+	tracer.MaxPayload = -1
+	if got := tracer.truncate(records[0].Payload); got != "" {
+		t.Errorf("unexpected truncation %s", got)
+	}
+
+	// stopped
+	ctx.SetTracer(nil)
+	obj.Methods[0].call("test", req, "{}")
+	if buf.Len() != 0 {
+		t.Errorf("unexpected trace %s", buf.String())
+	}
+
+	if _, err := ReadUbusTrace(strings.NewReader("{\n")); err == nil {
+		t.Error("expect error for a broken line")
+	}
+}
@@ -0,0 +1,209 @@
+package openwrt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/hzwesoft-github/underscore/lang"
+)
+
+// handler of a typed method, the error is replied as its UbusStatusOf
+type UbusTypedHandler[Req any, Resp any] func(ctx context.Context, req Req) (Resp, error)
+
+/*
+Add a method whose arguments are decoded into Req and whose result is sent as
+the reply, a nil result sends no reply. the policy of the method is derived from
+the fields of Req, see UbusMethodFieldsOf, fields tagged `v:"required"` are
+required.
+
+arguments that can't be decoded or don't pass lang.Validate are answered with
+UBUS_STATUS_INVALID_ARGUMENT without calling handler.
+*/
+func AddTypedMethod[Req any, Resp any](obj *UbusObject, name string, handler UbusTypedHandler[Req, Resp]) {
+	var zero Req
+
+	obj.AddMethod(name, func(objName string, method string, req *UbusRequestData, msg string) error {
+		var args Req
+		if err := _DecodeUbusArgs(req, reflect.ValueOf(&args).Elem()); err != nil {
+			return err
+		}
+
+		resp, err := handler(req.goContext(), args)
+		if err != nil {
+			return err
+		}
+
+		if _IsNilUbusReply(resp) {
+			return nil
+		}
+
+		return req.ctx.SendReply(req, resp)
+	}, UbusMethodFieldsOf(zero)...)
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+/*
+An object named name whose methods are the exported methods of service of the
+form
+
+	func (s *Service) GetStatus(ctx context.Context, req *StatusReq) (*StatusResp, error)
+
+each one is a typed method, see AddTypedMethod, named in snake case, here
+get_status. other methods of service are left out, it's an error if none is
+left.
+*/
+func UbusObjectOf(name string, service any) (*UbusObject, error) {
+	rv := reflect.ValueOf(service)
+	if !rv.IsValid() {
+		return nil, errors.New("ng: ubus service is nil")
+	}
+
+	obj := &UbusObject{Name: name}
+
+	t := rv.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !m.IsExported() || !_IsUbusServiceMethod(m.Type) {
+			continue
+		}
+
+		fn := rv.Method(i)
+		reqType := m.Type.In(2)
+
+		obj.AddMethod(_UbusMethodName(m.Name), func(objName string, method string, req *UbusRequestData, msg string) error {
+			args := reflect.New(reqType).Elem()
+			if err := _DecodeUbusArgs(req, args); err != nil {
+				return err
+			}
+
+			out := fn.Call([]reflect.Value{reflect.ValueOf(req.goContext()), args})
+			if err, _ := out[1].Interface().(error); err != nil {
+				return err
+			}
+
+			resp := out[0].Interface()
+			if _IsNilUbusReply(resp) {
+				return nil
+			}
+
+			return req.ctx.SendReply(req, resp)
+		}, UbusMethodFieldsOf(reflect.New(reqType).Interface())...)
+	}
+
+	if len(obj.Methods) == 0 {
+		return nil, fmt.Errorf("ng: no ubus methods in %T", service)
+	}
+
+	return obj, nil
+}
+
+// add service as the object name, see UbusObjectOf
+func (client *UbusClient) AddService(name string, service any) error {
+	obj, err := UbusObjectOf(name, service)
+	if err != nil {
+		return err
+	}
+
+	client.AddObject(obj)
+	return nil
+}
+
+// func(recv, context.Context, *Req) (Resp, error) as given by reflect.Type.Method
+func _IsUbusServiceMethod(t reflect.Type) bool {
+	if t.NumIn() != 3 || t.NumOut() != 2 {
+		return false
+	}
+
+	req := t.In(2)
+	return t.In(1) == contextType &&
+		req.Kind() == reflect.Pointer && req.Elem().Kind() == reflect.Struct &&
+		t.Out(1) == errorType
+}
+
+// GetStatus to get_status, HTTPProxy to http_proxy
+func _UbusMethodName(name string) string {
+	runes := []rune(name)
+
+	var builder strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				builder.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
+
+// decode the arguments of req into rv, allocating it if it's a pointer, and
+// validate a struct with lang.Validate
+func _DecodeUbusArgs(req *UbusRequestData, rv reflect.Value) error {
+	if rv.Kind() == reflect.Pointer {
+		rv.Set(reflect.New(rv.Type().Elem()))
+	}
+
+	if err := req.Decode(rv.Addr().Interface()); err != nil {
+		return &UbusStatusError{UBUS_STATUS_INVALID_ARGUMENT, err.Error()}
+	}
+
+	if reflect.Indirect(rv).Kind() == reflect.Struct {
+		if err := lang.Validate(rv.Interface()); err != nil {
+			return &UbusStatusError{UBUS_STATUS_INVALID_ARGUMENT, err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// the policy of a method taking v as its arguments, one field for each
+// member of the struct as named by BlobmsgMarshal
+func UbusMethodFieldsOf(v any) []UbusMethodField {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := make([]UbusMethodField, 0)
+	for _, field := range _BlobmsgFields(t) {
+		if field.skipDecode {
+			continue
+		}
+
+		sf := t.FieldByIndex(field.index)
+		fields = append(fields, UbusMethodField{
+			Name:     field.name,
+			Type:     _BlobmsgTypeOf(sf.Type, field.typ),
+			Required: strings.Contains(sf.Tag.Get("v"), "required"),
+		})
+	}
+
+	return fields
+}
+
+func _IsNilUbusReply(v any) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Interface, reflect.Slice:
+		return rv.IsNil()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !cgo || ubus_native
+
+package openwrt_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+	"github.com/hzwesoft-github/underscore/openwrt/ubustest"
+)
+
+type testService struct{}
+
+type testEcho struct {
+	Text string `json:"text" v:"required"`
+}
+
+func (s *testService) Echo(ctx context.Context, req *testEcho) (*testEcho, error) {
+	return &testEcho{Text: req.Text + req.Text}, nil
+}
+
+func TestUbusServiceInvoke(t *testing.T) {
+	b := ubustest.Start(t)
+
+	server := b.NewClient(t)
+	if err := server.AddService("service", &testService{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := b.NewClient(t)
+	ret, err := openwrt.Call[testEcho](client, "service", "echo", testEcho{"ab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Text != "abab" {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+
+	if _, err := openwrt.Call[testEcho](client, "service", "echo", nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_INVALID_ARGUMENT {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package openwrt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+type testUbusArgs struct {
+	Name string `json:"name" v:"required"`
+	Port int    `json:"port"`
+	Up   bool   `blobmsg:"up"`
+}
+
+func TestUbusMethodFieldsOf(t *testing.T) {
+	fields := UbusMethodFieldsOf(&testUbusArgs{})
+
+	expect := []UbusMethodField{{"name", BLOBMSG_TYPE_STRING, true}, {"port", BLOBMSG_TYPE_INT32, false}, {"up", BLOBMSG_TYPE_BOOL, false}}
+	if fmt.Sprint(fields) != fmt.Sprint(expect) {
+		t.Errorf("expect %v, got %v", expect, fields)
+	}
+}
+
+func TestUbusStatusOf(t *testing.T) {
+	if UbusStatusOf(fmt.Errorf("wrapped: %w", UBUS_STATUS_PERMISSION_DENIED)) != UBUS_STATUS_PERMISSION_DENIED {
+		t.Errorf("expect wrapped status")
+	}
+	if UbusStatusOf(os.ErrNotExist) != UBUS_STATUS_NOT_FOUND || UbusStatusOf(context.DeadlineExceeded) != UBUS_STATUS_TIMEOUT {
+		t.Errorf("expect status of well known errors")
+	}
+	if UBUS_STATUS_NOT_FOUND.Error() != "4: Not found" {
+		t.Errorf("unexpected message %s", UBUS_STATUS_NOT_FOUND.Error())
+	}
+}
+
+func TestAddTypedMethod(t *testing.T) {
+	obj := &UbusObject{Name: "test"}
+
+	var called *testUbusArgs
+	AddTypedMethod(obj, "set", func(ctx context.Context, args *testUbusArgs) (*testUbusArgs, error) {
+		called = args
+		return nil, UBUS_STATUS_NOT_SUPPORTED
+	})
+
+	if len(obj.Methods) != 1 || len(obj.Methods[0].Fields) != 3 {
+		t.Fatalf("unexpected methods %+v", obj.Methods)
+	}
+
+	invoke := func(msg any) UbusStatus {
+		data, _ := BlobmsgMarshal(msg)
+		return obj.Methods[0].call("test", &UbusRequestData{data: data}, "")
+	}
+
+	// required name is missing
+	if status := invoke(map[string]any{"port": 80}); status != UBUS_STATUS_INVALID_ARGUMENT || called != nil {
+		t.Errorf("expect invalid argument, got %v", status)
+	}
+
+	// required name is not a string
+	if status := invoke(map[string]any{"name": 1}); status != UBUS_STATUS_INVALID_ARGUMENT || called != nil {
+		t.Errorf("expect invalid argument, got %v", status)
+	}
+
+	// port is not a number
+	if status := invoke(map[string]any{"name": "lan", "port": "80"}); status != UBUS_STATUS_INVALID_ARGUMENT {
+		t.Errorf("expect invalid argument, got %v", status)
+	}
+
+	status := invoke(map[string]any{"name": "lan", "port": 80, "up": true})
+	if status != UBUS_STATUS_NOT_SUPPORTED {
+		t.Errorf("expect status of the handler, got %v", status)
+	}
+	if called == nil || called.Name != "lan" || called.Port != 80 || !called.Up {
+		t.Errorf("unexpected arguments %+v", called)
+	}
+}
+
+type testUbusService struct {
+	set *testUbusArgs
+}
+
+func (s *testUbusService) SetPort(ctx context.Context, args *testUbusArgs) (*testUbusArgs, error) {
+	s.set = args
+	return nil, nil
+}
+
+func (s *testUbusService) HTTPReload(ctx context.Context, args *struct{}) (map[string]any, error) {
+	return nil, UBUS_STATUS_NOT_SUPPORTED
+}
+
+// not of the form of a method
+func (s *testUbusService) Reset() {
+}
+
+func TestUbusObjectOf(t *testing.T) {
+	service := &testUbusService{}
+	obj, err := UbusObjectOf("test", service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(obj.Methods) != 2 || obj.Methods[0].Name != "http_reload" || obj.Methods[1].Name != "set_port" {
+		t.Fatalf("unexpected methods %+v", obj.Methods)
+	}
+	if fmt.Sprint(obj.Methods[1].Fields) != fmt.Sprint(UbusMethodFieldsOf(testUbusArgs{})) {
+		t.Errorf("unexpected fields %v", obj.Methods[1].Fields)
+	}
+
+	invoke := func(m *UbusMethod, msg any) UbusStatus {
+		data, _ := BlobmsgMarshal(msg)
+		return m.call("test", &UbusRequestData{data: data}, "")
+	}
+
+	if status := invoke(&obj.Methods[1], map[string]any{"port": 80}); status != UBUS_STATUS_INVALID_ARGUMENT || service.set != nil {
+		t.Errorf("expect invalid argument, got %v", status)
+	}
+	if status := invoke(&obj.Methods[1], map[string]any{"name": "lan", "port": 80}); status != UBUS_STATUS_OK || service.set == nil || service.set.Port != 80 {
+		t.Errorf("expect port set, got %v %+v", status, service.set)
+	}
+	if status := invoke(&obj.Methods[0], map[string]any{}); status != UBUS_STATUS_NOT_SUPPORTED {
+		t.Errorf("expect status of the method, got %v", status)
+	}
+
+	if _, err := UbusObjectOf("test", struct{}{}); err == nil {
+		t.Error("expect error for a value without methods")
+	}
+}
+
+func TestUbusMethodName(t *testing.T) {
+	for name, expect := range map[string]string{
+		"Status":     "status",
+		"GetStatus":  "get_status",
+		"HTTPProxy":  "http_proxy",
+		"ReloadAll2": "reload_all2",
+	} {
+		if got := _UbusMethodName(name); got != expect {
+			t.Errorf("%s: expect %s, got %s", name, expect, got)
+		}
+	}
+}
+
+func TestUbusStatusError(t *testing.T) {
+	method := UbusMethod{
+		Name: "get",
+		Handler: func(obj string, method string, req *UbusRequestData, msg string) error {
+			return NewUbusStatusError(UBUS_STATUS_PERMISSION_DENIED, "%s not allowed", method)
+		},
+	}
+
+	if status := method.call("test", &UbusRequestData{}, "{}"); status != UBUS_STATUS_PERMISSION_DENIED {
+		t.Errorf("expect permission denied, got %v", status)
+	}
+}
+
+func TestUbusAclMiddleware(t *testing.T) {
+	obj := UbusObject{Name: "test"}
+	obj.AddMethod("set", UbusAclMiddleware(func(obj string, method string, req *UbusRequestData, msg string) error {
+		if req.ObjectName() != "test" || req.Method() != "set" {
+			t.Errorf("unexpected request %s.%s", req.ObjectName(), req.Method())
+		}
+		return nil
+	}))
+	obj.AddMethod("get", UbusAclMiddleware(func(obj string, method string, req *UbusRequestData, msg string) error {
+		return nil
+	}))
+
+	if err := obj.SetMethodAcl("set", &UbusAcl{Users: []string{"root"}, Groups: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.SetMethodAcl("missing", nil); err == nil {
+		t.Error("expect error for a missing method")
+	}
+
+	for _, c := range []struct {
+		method string
+		user   string
+		group  string
+		status UbusStatus
+	}{
+		{"set", "root", "", UBUS_STATUS_OK},
+		{"set", "guest", "admin", UBUS_STATUS_OK},
+		{"set", "guest", "guest", UBUS_STATUS_PERMISSION_DENIED},
+		{"set", "", "", UBUS_STATUS_PERMISSION_DENIED},
+		{"get", "", "", UBUS_STATUS_OK},
+	} {
+		m := &obj.Methods[0]
+		if c.method == "get" {
+			m = &obj.Methods[1]
+		}
+
+		req := &UbusRequestData{user: c.user, group: c.group}
+		if status := m.call("test", req, "{}"); status != c.status {
+			t.Errorf("%s by %s/%s: expect %v, got %v", c.method, c.user, c.group, c.status, status)
+		}
+	}
+}
+
+func TestParseUbusSignature(t *testing.T) {
+	w := NewBlobWriter()
+	table := w.OpenTable("status")
+	w.Close(table)
+	table = w.OpenTable("set")
+	w.PutMsgInt32("name", int32(BLOBMSG_TYPE_STRING.wireType()))
+	w.PutMsgInt32("up", int32(BLOBMSG_TYPE_BOOL.wireType()))
+	w.PutMsgInt32("port", int32(BLOBMSG_TYPE_INT32.wireType()))
+	w.Close(table)
+
+	signature, err := _ParseUbusSignature(w.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string][]UbusMethodField{
+		"status": {},
+		"set":    {{"name", BLOBMSG_TYPE_STRING, false}, {"up", BLOBMSG_TYPE_BOOL, false}, {"port", BLOBMSG_TYPE_INT32, false}},
+	}
+	if fmt.Sprint(signature) != fmt.Sprint(expect) {
+		t.Errorf("expect %v, got %v", expect, signature)
+	}
+}
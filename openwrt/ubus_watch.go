@@ -0,0 +1,77 @@
+package openwrt
+
+import (
+	"context"
+
+	"github.com/hzwesoft-github/underscore/json"
+)
+
+// sent by ubusd when objects come and go, the data is {"id": ..., "path": ...}
+const (
+	UBUS_EVENT_OBJECT_ADD    = "ubus.object.add"
+	UBUS_EVENT_OBJECT_REMOVE = "ubus.object.remove"
+)
+
+// callback of WatchObjects, only Id and Path of obj are known
+type UbusObjectHandler func(added bool, obj UbusObjectData)
+
+const ubusObjectEventPattern = "ubus.object.*"
+
+/*
+Call cb whenever an object is added or removed, until stop is called.
+
+the events arrive through a listener, see ListenEvent. other listeners of
+ubus.object.* on the context keep getting them.
+*/
+func (ctx *UbusContext) WatchObjects(cb UbusObjectHandler) (stop func() error, err error) {
+	return ctx.ListenEvent(ubusObjectEventPattern, func(event string, msg string) {
+		var data struct {
+			Id   uint32 `json:"id"`
+			Path string `json:"path"`
+		}
+		if err := json.UnmarshalFromString(msg, &data); err != nil {
+			return
+		}
+
+		cb(event == UBUS_EVENT_OBJECT_ADD, UbusObjectData{Id: data.Id, Path: data.Path})
+	})
+}
+
+// wait until the object at path exists and return its id, e.g. for a service
+// depending on network.interface.wan. see WatchObjects for how events arrive
+func (ctx *UbusContext) WaitObject(goCtx context.Context, path string) (uint32, error) {
+	added := make(chan uint32, 1)
+
+	// watch before the lookup, so the object can't show up in between
+	stop, err := ctx.WatchObjects(func(ok bool, obj UbusObjectData) {
+		if ok && obj.Path == path {
+			select {
+			case added <- obj.Id:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+
+	id, err := ctx.LookupIdContext(goCtx, path)
+	if err == nil {
+		return id, nil
+	}
+	if UbusStatusOf(err) != UBUS_STATUS_NOT_FOUND {
+		return 0, err
+	}
+
+	select {
+	case id = <-added:
+		return id, nil
+	case <-goCtx.Done():
+		return 0, goCtx.Err()
+	}
+}
+
+func (client *UbusClient) WaitObject(goCtx context.Context, path string) (uint32, error) {
+	return client.Context.WaitObject(goCtx, path)
+}
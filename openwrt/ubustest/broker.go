@@ -0,0 +1,767 @@
+/*
+Package ubustest runs an in-process stand-in for ubusd, so code talking to
+ubus can be tested without a router.
+
+	b := ubustest.Start(t)
+	b.AddObject("network.interface.wan").Reply("status", map[string]any{"up": true})
+
+	client := b.NewClient(t)
+
+the broker speaks the ubusd socket protocol: it keeps the object registry,
+routes invokes and their replies, events, subscriptions and notifications.
+it is meant for the native client, build the tests with CGO_ENABLED=0 or the
+ubus_native tag.
+*/
+package ubustest
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+)
+
+// an event sent through the broker
+type Event struct {
+	Id   string
+	Data map[string]any
+}
+
+type Broker struct {
+	// unix socket to connect to, see openwrt.UbusConfig
+	Sock string
+	// ACL user and group sent along with every invoke, as ubusd does for
+	// callers matched by its acl files. set before clients connect
+	User  string
+	Group string
+
+	dir      string
+	listener net.Listener
+
+	// guards the fields below
+	mutex   sync.Mutex
+	closed  bool
+	lastId  uint32
+	clients map[uint32]*_BrokerClient
+	objects map[uint32]*_BrokerObject
+	events  []Event
+}
+
+type _BrokerClient struct {
+	id   uint32
+	conn net.Conn
+
+	writeMutex sync.Mutex
+}
+
+type _BrokerObject struct {
+	id     uint32
+	typeId uint32
+	path   string
+	// packed method tables, as sent by the client
+	signature []byte
+
+	// owner of the object, nil for an Object of the broker
+	client *_BrokerClient
+	fake   *Object
+
+	// event patterns registered on the object
+	patterns []string
+	// ids of the objects subscribed to this one
+	subscribers map[uint32]bool
+}
+
+// a message to send once the broker is unlocked
+type _BrokerOutbox []struct {
+	client *_BrokerClient
+	msg    *openwrt.UbusMessage
+}
+
+func (out *_BrokerOutbox) add(client *_BrokerClient, msg *openwrt.UbusMessage) {
+	if client == nil {
+		return
+	}
+
+	*out = append(*out, struct {
+		client *_BrokerClient
+		msg    *openwrt.UbusMessage
+	}{client, msg})
+}
+
+func (out _BrokerOutbox) flush() {
+	for _, item := range out {
+		item.client.send(item.msg)
+	}
+}
+
+func (client *_BrokerClient) send(msg *openwrt.UbusMessage) {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	msg.WriteTo(client.conn)
+}
+
+// a broker listening on a socket in a new temp directory
+func NewBroker() (*Broker, error) {
+	dir, err := os.MkdirTemp("", "ubustest")
+	if err != nil {
+		return nil, err
+	}
+
+	sock := filepath.Join(dir, "ubus.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	b := &Broker{
+		Sock:     sock,
+		dir:      dir,
+		listener: listener,
+		// below the ids of the system objects
+		lastId:  0x100,
+		clients: make(map[uint32]*_BrokerClient),
+		objects: make(map[uint32]*_BrokerObject),
+	}
+
+	go b.accept()
+
+	return b, nil
+}
+
+// a broker closed when the test ends
+func Start(t testing.TB) *Broker {
+	t.Helper()
+
+	b, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	return b
+}
+
+// a client of the broker freed when the test ends
+func (b *Broker) NewClient(t testing.TB) *openwrt.UbusClient {
+	t.Helper()
+
+	client, err := openwrt.NewUbusClientWithConfig(context.Background(), &openwrt.UbusConfig{Sock: b.Sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Free)
+
+	return client
+}
+
+// the next value of ch, the test fails if none comes within 2 seconds
+func Wait[T any](t testing.TB, ch chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	var v T
+	return v
+}
+
+// stop listening and drop all clients
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mutex.Unlock()
+
+	err := b.listener.Close()
+	b.Disconnect()
+	os.RemoveAll(b.dir)
+
+	return err
+}
+
+// drop all clients as a restart of ubusd would, their objects are removed.
+// clients with UbusConfig.Reconnect connect again
+func (b *Broker) Disconnect() {
+	b.mutex.Lock()
+	clients := make([]*_BrokerClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		clients = append(clients, client)
+	}
+	b.mutex.Unlock()
+
+	for _, client := range clients {
+		client.conn.Close()
+	}
+}
+
+// the events sent so far, in order
+func (b *Broker) Events() []Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]Event(nil), b.events...)
+}
+
+// paths of the objects registered, sorted
+func (b *Broker) Paths() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	paths := make([]string, 0, len(b.objects))
+	for _, o := range b.objects {
+		if o.path != "" {
+			paths = append(paths, o.path)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		client := &_BrokerClient{id: b.newId(), conn: conn}
+		b.clients[client.id] = client
+		b.mutex.Unlock()
+
+		go b.serve(client)
+	}
+}
+
+func (b *Broker) serve(client *_BrokerClient) {
+	client.send(&openwrt.UbusMessage{Type: openwrt.UBUS_MSG_HELLO, Peer: client.id})
+
+	for {
+		msg, err := openwrt.ReadUbusMessage(client.conn)
+		if err != nil {
+			break
+		}
+
+		b.handle(client, msg)
+	}
+
+	client.conn.Close()
+
+	var out _BrokerOutbox
+
+	b.mutex.Lock()
+	delete(b.clients, client.id)
+	for _, o := range b.sortedObjects() {
+		if o.client == client {
+			b.removeObject(&out, o)
+		}
+	}
+	b.mutex.Unlock()
+
+	out.flush()
+}
+
+// must hold the mutex
+func (b *Broker) newId() uint32 {
+	b.lastId++
+	return b.lastId
+}
+
+// must hold the mutex
+func (b *Broker) sortedObjects() []*_BrokerObject {
+	objects := make([]*_BrokerObject, 0, len(b.objects))
+	for _, o := range b.objects {
+		objects = append(objects, o)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].id < objects[j].id })
+
+	return objects
+}
+
+// must hold the mutex
+func (b *Broker) objectByPath(path string) *_BrokerObject {
+	for _, o := range b.objects {
+		if o.path != "" && o.path == path {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// a status of -1 sends none, the reply comes from the owner of the object
+const brokerNoStatus = openwrt.UbusStatus(-1)
+
+func (b *Broker) handle(client *_BrokerClient, msg *openwrt.UbusMessage) {
+	attrs, err := msg.Attrs()
+	if err != nil {
+		b.status(client, msg, openwrt.UBUS_STATUS_INVALID_ARGUMENT)
+		return
+	}
+
+	var out _BrokerOutbox
+	status := brokerNoStatus
+
+	switch msg.Type {
+	case openwrt.UBUS_MSG_PING:
+		status = openwrt.UBUS_STATUS_OK
+	case openwrt.UBUS_MSG_LOOKUP:
+		status = b.lookup(&out, client, msg, attrs)
+	case openwrt.UBUS_MSG_ADD_OBJECT:
+		status = b.addObject(&out, client, msg, attrs)
+	case openwrt.UBUS_MSG_REMOVE_OBJECT:
+		status = b.handleRemove(&out, client, msg, attrs)
+	case openwrt.UBUS_MSG_INVOKE:
+		status = b.invoke(&out, client, msg, attrs)
+	case openwrt.UBUS_MSG_DATA, openwrt.UBUS_MSG_STATUS:
+		b.forward(&out, client, msg, attrs)
+	case openwrt.UBUS_MSG_SUBSCRIBE, openwrt.UBUS_MSG_UNSUBSCRIBE:
+		status = b.subscribe(&out, client, msg, attrs)
+	case openwrt.UBUS_MSG_NOTIFY:
+		status = b.notify(&out, client, msg, attrs)
+	default:
+		status = openwrt.UBUS_STATUS_INVALID_COMMAND
+	}
+
+	out.flush()
+
+	// passed on by flush, if at all
+	if msg.File != nil {
+		msg.File.Close()
+	}
+
+	if status != brokerNoStatus {
+		b.status(client, msg, status)
+	}
+}
+
+func (b *Broker) status(client *_BrokerClient, msg *openwrt.UbusMessage, status openwrt.UbusStatus) {
+	w := openwrt.NewBlobWriter()
+	w.PutUint32(openwrt.UBUS_ATTR_STATUS, uint32(status))
+	client.send(&openwrt.UbusMessage{Type: openwrt.UBUS_MSG_STATUS, Seq: msg.Seq, Peer: msg.Peer, Data: w.Bytes()})
+}
+
+func _Reply(msg *openwrt.UbusMessage, w *openwrt.BlobWriter) *openwrt.UbusMessage {
+	return &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_DATA, Seq: msg.Seq, Peer: msg.Peer, Data: w.Bytes()}
+}
+
+// same matching as ubusd, a trailing * matches any suffix
+func _MatchPattern(pattern string, s string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(s, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return pattern == s
+}
+
+func (b *Broker) lookup(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) openwrt.UbusStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	pattern := "*"
+	if attr := attrs[openwrt.UBUS_ATTR_OBJPATH]; attr != nil {
+		pattern = attr.GetString()
+	}
+
+	found := false
+	for _, o := range b.sortedObjects() {
+		if o.path == "" || !_MatchPattern(pattern, o.path) {
+			continue
+		}
+
+		w := openwrt.NewBlobWriter()
+		w.PutString(openwrt.UBUS_ATTR_OBJPATH, o.path)
+		w.PutUint32(openwrt.UBUS_ATTR_OBJID, o.id)
+		w.PutUint32(openwrt.UBUS_ATTR_OBJTYPE, o.typeId)
+		if o.fake != nil {
+			w.Put(openwrt.UBUS_ATTR_SIGNATURE, o.fake.signature())
+		} else {
+			w.Put(openwrt.UBUS_ATTR_SIGNATURE, o.signature)
+		}
+		out.add(client, _Reply(msg, w))
+
+		found = true
+	}
+
+	// ubusd finds nothing without complaint only when listing everything
+	if !found && attrs[openwrt.UBUS_ATTR_OBJPATH] != nil {
+		return openwrt.UBUS_STATUS_NOT_FOUND
+	}
+
+	return openwrt.UBUS_STATUS_OK
+}
+
+// must hold the mutex
+func (b *Broker) register(out *_BrokerOutbox, o *_BrokerObject) {
+	o.id = b.newId()
+	if o.path != "" {
+		o.typeId = b.newId()
+	}
+	b.objects[o.id] = o
+
+	if o.path != "" {
+		b.objectEvent(out, openwrt.UBUS_EVENT_OBJECT_ADD, o)
+	}
+}
+
+func (b *Broker) addObject(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) openwrt.UbusStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	o := &_BrokerObject{client: client}
+	if attr := attrs[openwrt.UBUS_ATTR_OBJPATH]; attr != nil {
+		o.path = attr.GetString()
+		if b.objectByPath(o.path) != nil {
+			return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+		}
+	}
+	if attr := attrs[openwrt.UBUS_ATTR_SIGNATURE]; attr != nil {
+		o.signature = append([]byte(nil), attr.Data...)
+	}
+
+	var events _BrokerOutbox
+	b.register(&events, o)
+
+	w := openwrt.NewBlobWriter()
+	w.PutUint32(openwrt.UBUS_ATTR_OBJID, o.id)
+	if o.typeId != 0 {
+		w.PutUint32(openwrt.UBUS_ATTR_OBJTYPE, o.typeId)
+	}
+	out.add(client, _Reply(msg, w))
+	*out = append(*out, events...)
+
+	return openwrt.UBUS_STATUS_OK
+}
+
+func (b *Broker) handleRemove(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) openwrt.UbusStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if attrs[openwrt.UBUS_ATTR_OBJID] == nil {
+		return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	o := b.objects[attrs[openwrt.UBUS_ATTR_OBJID].GetUint32()]
+	if o == nil {
+		return openwrt.UBUS_STATUS_NOT_FOUND
+	}
+	if o.client != client {
+		return openwrt.UBUS_STATUS_PERMISSION_DENIED
+	}
+
+	w := openwrt.NewBlobWriter()
+	w.PutUint32(openwrt.UBUS_ATTR_OBJID, o.id)
+	if o.typeId != 0 {
+		w.PutUint32(openwrt.UBUS_ATTR_OBJTYPE, o.typeId)
+	}
+	out.add(client, _Reply(msg, w))
+
+	b.removeObject(out, o)
+
+	return openwrt.UBUS_STATUS_OK
+}
+
+// drop o and its subscriptions, must hold the mutex
+func (b *Broker) removeObject(out *_BrokerOutbox, o *_BrokerObject) {
+	delete(b.objects, o.id)
+
+	// tell the subscribers their target is gone
+	for id := range o.subscribers {
+		if s := b.objects[id]; s != nil {
+			w := openwrt.NewBlobWriter()
+			w.PutUint32(openwrt.UBUS_ATTR_OBJID, s.id)
+			w.PutUint32(openwrt.UBUS_ATTR_TARGET, o.id)
+			out.add(s.client, &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_UNSUBSCRIBE, Data: w.Bytes()})
+		}
+	}
+
+	// and the targets o was subscribed to
+	for _, target := range b.sortedObjects() {
+		if target.subscribers[o.id] {
+			b.unsubscribe(out, target, o.id)
+		}
+	}
+
+	if o.path != "" {
+		b.objectEvent(out, openwrt.UBUS_EVENT_OBJECT_REMOVE, o)
+	}
+}
+
+// must hold the mutex
+func (b *Broker) objectEvent(out *_BrokerOutbox, id string, o *_BrokerObject) {
+	w := openwrt.NewBlobWriter()
+	w.PutMsgInt32("id", int32(o.id))
+	w.PutMsgString("path", o.path)
+	b.event(out, id, w.Bytes())
+}
+
+// deliver an event to the matching listeners, must hold the mutex
+func (b *Broker) event(out *_BrokerOutbox, id string, data []byte) {
+	ev := Event{Id: id}
+	openwrt.BlobmsgUnmarshal(data, &ev.Data)
+	b.events = append(b.events, ev)
+
+	for _, o := range b.sortedObjects() {
+		for _, pattern := range o.patterns {
+			if !_MatchPattern(pattern, id) {
+				continue
+			}
+
+			w := openwrt.NewBlobWriter()
+			w.PutUint32(openwrt.UBUS_ATTR_OBJID, o.id)
+			w.PutString(openwrt.UBUS_ATTR_METHOD, id)
+			w.Put(openwrt.UBUS_ATTR_DATA, data)
+			out.add(o.client, &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_INVOKE, Data: w.Bytes()})
+			break
+		}
+	}
+}
+
+func (b *Broker) invoke(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) openwrt.UbusStatus {
+	if attrs[openwrt.UBUS_ATTR_OBJID] == nil || attrs[openwrt.UBUS_ATTR_METHOD] == nil {
+		return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	id := attrs[openwrt.UBUS_ATTR_OBJID].GetUint32()
+	method := attrs[openwrt.UBUS_ATTR_METHOD].GetString()
+
+	var data []byte
+	if attr := attrs[openwrt.UBUS_ATTR_DATA]; attr != nil {
+		data = attr.Data
+	}
+
+	if id == openwrt.UBUS_SYSTEM_OBJECT_EVENT {
+		return b.system(out, client, method, data)
+	}
+
+	b.mutex.Lock()
+	o := b.objects[id]
+	b.mutex.Unlock()
+
+	if o == nil {
+		return openwrt.UBUS_STATUS_NOT_FOUND
+	}
+
+	if o.fake != nil {
+		// outside of the lock, the handler may use the broker
+		reply, status := o.fake.call(method, data)
+		if reply != nil {
+			w := openwrt.NewBlobWriter()
+			w.PutUint32(openwrt.UBUS_ATTR_OBJID, o.id)
+			w.Put(openwrt.UBUS_ATTR_DATA, reply)
+			out.add(client, &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_DATA, Seq: msg.Seq, Peer: o.id, Data: w.Bytes()})
+		}
+		return status
+	}
+
+	w := openwrt.NewBlobWriter()
+	w.PutUint32(openwrt.UBUS_ATTR_OBJID, o.id)
+	w.PutString(openwrt.UBUS_ATTR_METHOD, method)
+	w.Put(openwrt.UBUS_ATTR_DATA, data)
+	if attr := attrs[openwrt.UBUS_ATTR_NO_REPLY]; attr != nil {
+		w.PutUint8(openwrt.UBUS_ATTR_NO_REPLY, attr.GetUint8())
+	}
+	if b.User != "" {
+		w.PutString(openwrt.UBUS_ATTR_USER, b.User)
+	}
+	if b.Group != "" {
+		w.PutString(openwrt.UBUS_ATTR_GROUP, b.Group)
+	}
+	// the owner replies to the peer, forward sends it on
+	out.add(o.client, &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_INVOKE, Seq: msg.Seq, Peer: client.id, Data: w.Bytes(), File: msg.File})
+
+	return brokerNoStatus
+}
+
+// the methods of the event object, register and send
+func (b *Broker) system(out *_BrokerOutbox, client *_BrokerClient, method string, data []byte) openwrt.UbusStatus {
+	args, err := openwrt.ParseBlobAttrs(data)
+	if err != nil {
+		return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	named := make(map[string]*openwrt.BlobAttr, len(args))
+	for i := range args {
+		named[args[i].Name] = &args[i]
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch method {
+	case "register":
+		if named["object"] == nil || named["pattern"] == nil {
+			return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+		}
+
+		o := b.objects[named["object"].GetUint32()]
+		if o == nil || o.client != client {
+			return openwrt.UBUS_STATUS_NOT_FOUND
+		}
+		o.patterns = append(o.patterns, named["pattern"].GetString())
+
+		return openwrt.UBUS_STATUS_OK
+	case "send":
+		if named["id"] == nil {
+			return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+		}
+
+		var payload []byte
+		if attr := named["data"]; attr != nil {
+			payload = attr.Data
+		}
+		b.event(out, named["id"].GetString(), payload)
+
+		return openwrt.UBUS_STATUS_OK
+	default:
+		return openwrt.UBUS_STATUS_METHOD_NOT_FOUND
+	}
+}
+
+// relay a reply of an object owner to the client that invoked it
+func (b *Broker) forward(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) {
+	if attrs[openwrt.UBUS_ATTR_OBJID] == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	o := b.objects[attrs[openwrt.UBUS_ATTR_OBJID].GetUint32()]
+	if o == nil || o.client != client {
+		return
+	}
+
+	// replies to events and notifications have no peer
+	dest := b.clients[msg.Peer]
+	out.add(dest, &openwrt.UbusMessage{Type: msg.Type, Seq: msg.Seq, Peer: o.id, Data: msg.Data, File: msg.File})
+}
+
+func (b *Broker) subscribe(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) openwrt.UbusStatus {
+	if attrs[openwrt.UBUS_ATTR_OBJID] == nil || attrs[openwrt.UBUS_ATTR_TARGET] == nil {
+		return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.objects[attrs[openwrt.UBUS_ATTR_OBJID].GetUint32()]
+	if s == nil || s.client != client {
+		return openwrt.UBUS_STATUS_NOT_FOUND
+	}
+	target := b.objects[attrs[openwrt.UBUS_ATTR_TARGET].GetUint32()]
+	if target == nil {
+		return openwrt.UBUS_STATUS_NOT_FOUND
+	}
+
+	if msg.Type == openwrt.UBUS_MSG_UNSUBSCRIBE {
+		b.unsubscribe(out, target, s.id)
+		return openwrt.UBUS_STATUS_OK
+	}
+
+	if target.subscribers == nil {
+		target.subscribers = make(map[uint32]bool)
+	}
+	if len(target.subscribers) == 0 {
+		b.active(out, target, true)
+	}
+	target.subscribers[s.id] = true
+
+	return openwrt.UBUS_STATUS_OK
+}
+
+// must hold the mutex
+func (b *Broker) unsubscribe(out *_BrokerOutbox, target *_BrokerObject, id uint32) {
+	if !target.subscribers[id] {
+		return
+	}
+
+	delete(target.subscribers, id)
+	if len(target.subscribers) == 0 {
+		b.active(out, target, false)
+	}
+}
+
+// tell the owner of target whether it has subscribers, must hold the mutex
+func (b *Broker) active(out *_BrokerOutbox, target *_BrokerObject, active bool) {
+	w := openwrt.NewBlobWriter()
+	w.PutUint32(openwrt.UBUS_ATTR_OBJID, target.id)
+	if active {
+		w.PutUint8(openwrt.UBUS_ATTR_ACTIVE, 1)
+	} else {
+		w.PutUint8(openwrt.UBUS_ATTR_ACTIVE, 0)
+	}
+	out.add(target.client, &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_NOTIFY, Data: w.Bytes()})
+}
+
+func (b *Broker) notify(out *_BrokerOutbox, client *_BrokerClient, msg *openwrt.UbusMessage, attrs map[int]*openwrt.BlobAttr) openwrt.UbusStatus {
+	if attrs[openwrt.UBUS_ATTR_OBJID] == nil || attrs[openwrt.UBUS_ATTR_METHOD] == nil {
+		return openwrt.UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	o := b.objects[attrs[openwrt.UBUS_ATTR_OBJID].GetUint32()]
+	if o == nil || o.client != client {
+		return openwrt.UBUS_STATUS_NOT_FOUND
+	}
+
+	var data []byte
+	if attr := attrs[openwrt.UBUS_ATTR_DATA]; attr != nil {
+		data = attr.Data
+	}
+	b.fanOut(out, o, attrs[openwrt.UBUS_ATTR_METHOD].GetString(), data, client.id, msg.Seq)
+
+	// the replies of the subscribers are not collected
+	if attr := attrs[openwrt.UBUS_ATTR_NO_REPLY]; attr != nil && attr.GetBool() {
+		return brokerNoStatus
+	}
+
+	return openwrt.UBUS_STATUS_OK
+}
+
+// send a notification of o to its subscribers, must hold the mutex
+func (b *Broker) fanOut(out *_BrokerOutbox, o *_BrokerObject, typ string, data []byte, peer uint32, seq uint16) {
+	ids := make([]uint32, 0, len(o.subscribers))
+	for id := range o.subscribers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		s := b.objects[id]
+		if s == nil {
+			continue
+		}
+
+		w := openwrt.NewBlobWriter()
+		w.PutUint32(openwrt.UBUS_ATTR_OBJID, s.id)
+		w.PutString(openwrt.UBUS_ATTR_METHOD, typ)
+		w.Put(openwrt.UBUS_ATTR_DATA, data)
+		w.PutUint8(openwrt.UBUS_ATTR_NO_REPLY, 1)
+		out.add(s.client, &openwrt.UbusMessage{Type: openwrt.UBUS_MSG_INVOKE, Seq: seq, Peer: peer, Data: w.Bytes()})
+	}
+}
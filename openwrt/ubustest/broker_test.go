@@ -0,0 +1,262 @@
+//go:build !cgo || ubus_native
+
+package ubustest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/json"
+	"github.com/hzwesoft-github/underscore/openwrt"
+)
+
+func TestBrokerObject(t *testing.T) {
+	b := Start(t)
+	obj := b.AddObject("network.interface.wan").
+		Reply("status", map[string]any{"up": true, "l3_device": "eth1"}).
+		Fail("down", openwrt.UBUS_STATUS_PERMISSION_DENIED)
+
+	client := b.NewClient(t)
+
+	type status struct {
+		Up     bool   `json:"up"`
+		Device string `json:"l3_device"`
+	}
+	ret, err := openwrt.Call[status](client, "network.interface.wan", "status", map[string]any{"name": "wan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.Up || ret.Device != "eth1" {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+
+	if _, err := openwrt.Call[status](client, "network.interface.wan", "down", nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_PERMISSION_DENIED {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if _, err := openwrt.Call[status](client, "network.interface.wan", "renew", nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_METHOD_NOT_FOUND {
+		t.Fatalf("expected method not found, got %v", err)
+	}
+	if _, err := openwrt.Call[status](client, "network.interface.lan", "status", nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_NOT_FOUND {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	calls := obj.Calls()
+	if len(calls) != 3 || calls[0].Method != "status" || calls[0].Args["name"] != "wan" {
+		t.Fatalf("unexpected calls %+v", calls)
+	}
+	if len(obj.CallsTo("down")) != 1 {
+		t.Fatal("call to down not recorded")
+	}
+
+	objects, err := client.Context.Lookup("network.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Path != "network.interface.wan" {
+		t.Fatalf("unexpected lookup %+v", objects)
+	}
+	if _, ok := objects[0].Signature["status"]; !ok {
+		t.Fatalf("status missing from signature %+v", objects[0].Signature)
+	}
+}
+
+// the invoke part of example/ubus
+func TestBrokerInvoke(t *testing.T) {
+	b := Start(t)
+
+	type message struct {
+		F1 string `json:"f1"`
+		F2 int32  `json:"f2"`
+	}
+
+	server := b.NewClient(t)
+	obj := openwrt.UbusObject{Name: "test_obj"}
+	obj.AddMethod("method1", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		return server.SendReply(req, msg)
+	},
+		openwrt.UbusMethodField{Name: "f1", Type: openwrt.BLOBMSG_TYPE_STRING},
+		openwrt.UbusMethodField{Name: "f2", Type: openwrt.BLOBMSG_TYPE_INT32},
+	)
+	server.AddObject(&obj)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := b.NewClient(t)
+	for i := int32(0); i < 3; i++ {
+		ret, err := openwrt.Call[message](client, "test_obj", "method1", message{"f", i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret.F1 != "f" || ret.F2 != i {
+			t.Fatalf("unexpected reply %+v", ret)
+		}
+	}
+
+	objects, err := client.Context.Lookup("test_obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || len(objects[0].Signature["method1"]) != 2 {
+		t.Fatalf("unexpected lookup %+v", objects)
+	}
+
+	if err := server.RemoveObject("test_obj"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openwrt.Call[message](client, "test_obj", "method1", nil); openwrt.UbusStatusOf(err) != openwrt.UBUS_STATUS_NOT_FOUND {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestBrokerEvent(t *testing.T) {
+	b := Start(t)
+
+	received := make(chan string, 4)
+	listener := b.NewClient(t)
+	listener.RegisterEvent("test.*", func(event string, msg string) {
+		received <- event + " " + msg
+	})
+	if err := listener.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := b.NewClient(t)
+	if err := sender.SendEvent("other", map[string]any{"n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendEvent("test.event", map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := Wait(t, received); got != `test.event {"n":1}` {
+		t.Fatalf("unexpected event %s", got)
+	}
+
+	events := b.Events()
+	if len(events) != 2 || events[1].Id != "test.event" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if n, _ := json.MarshalToString(events[1].Data); n != `{"n":1}` {
+		t.Fatalf("unexpected event data %s", n)
+	}
+}
+
+func TestBrokerWatch(t *testing.T) {
+	b := Start(t)
+	client := b.NewClient(t)
+
+	found := make(chan uint32, 1)
+	go func() {
+		id, err := client.WaitObject(context.Background(), "late")
+		if err != nil {
+			t.Error(err)
+		}
+		found <- id
+	}()
+
+	// let the watch start before the object shows up
+	time.Sleep(50 * time.Millisecond)
+	obj := b.AddObject("late")
+
+	if id := Wait(t, found); id != obj.id {
+		t.Fatalf("expected id %d, got %d", obj.id, id)
+	}
+}
+
+func TestBrokerNotify(t *testing.T) {
+	b := Start(t)
+	obj := b.AddObject("hostapd.wlan0")
+
+	notified := make(chan string, 1)
+	removed := make(chan uint32, 1)
+
+	client := b.NewClient(t)
+	client.Subscribe("hostapd.wlan0", &openwrt.UbusSubscriber{
+		Handler: func(typ string, msg string) error {
+			notified <- typ + " " + msg
+			return nil
+		},
+		RemoveHandler: func(id uint32) {
+			removed <- id
+		},
+	})
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if obj.Subscribers() != 1 {
+		t.Fatal("subscriber not registered")
+	}
+
+	if err := obj.Notify("assoc", map[string]any{"address": "00:11:22:33:44:55"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := Wait(t, notified); got != `assoc {"address":"00:11:22:33:44:55"}` {
+		t.Fatalf("unexpected notification %s", got)
+	}
+
+	obj.Remove()
+	if id := Wait(t, removed); id != obj.id {
+		t.Fatalf("expected removal of %d, got %d", obj.id, id)
+	}
+}
+
+func TestBrokerPublish(t *testing.T) {
+	b := Start(t)
+
+	publisher := b.NewClient(t)
+	obj := openwrt.UbusObject{Name: "publisher"}
+	publisher.AddObject(&obj)
+	if err := publisher.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	notified := make(chan string, 1)
+	subscriber := b.NewClient(t)
+	subscriber.Subscribe("publisher", &openwrt.UbusSubscriber{
+		Handler: func(typ string, msg string) error {
+			notified <- typ + " " + msg
+			return nil
+		},
+	})
+	if err := subscriber.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := obj.Notify("update", map[string]any{"v": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := Wait(t, notified); got != `update {"v":2}` {
+		t.Fatalf("unexpected notification %s", got)
+	}
+}
+
+func TestBrokerReconnect(t *testing.T) {
+	b := Start(t)
+
+	reconnected := make(chan bool, 1)
+	client, err := openwrt.NewUbusClientWithConfig(context.Background(), &openwrt.UbusConfig{
+		Sock:        b.Sock,
+		Reconnect:   true,
+		Backoff:     10 * time.Millisecond,
+		OnReconnect: func() { reconnected <- true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Free()
+
+	obj := openwrt.UbusObject{Name: "survivor"}
+	client.AddObject(&obj)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Disconnect()
+	Wait(t, reconnected)
+
+	if paths := b.Paths(); len(paths) != 1 || paths[0] != "survivor" {
+		t.Fatalf("object not added again, have %v", paths)
+	}
+}
@@ -0,0 +1,157 @@
+//go:build !cgo || ubus_native
+
+package ubustest
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+)
+
+func newTestGateway(t *testing.T) (*Broker, *openwrt.UbusGateway, *httptest.Server) {
+	t.Helper()
+
+	b := Start(t)
+	b.AddObject("system").Reply("board", map[string]any{"model": "test", "cores": 4})
+
+	gateway := openwrt.NewUbusGateway(b.NewClient(t))
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	return b, gateway, server
+}
+
+func post(t *testing.T, server *httptest.Server, body string) string {
+	t.Helper()
+
+	resp, err := http.Post(server.URL+"/ubus", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestGatewayCall(t *testing.T) {
+	b, _, server := newTestGateway(t)
+
+	got := post(t, server, `{"jsonrpc":"2.0","id":1,"method":"call","params":["`+openwrt.UBUS_GATEWAY_NO_SESSION+`","system","board",{"verbose":1}]}`)
+	if got != `{"jsonrpc":"2.0","id":1,"result":[0,{"cores":4,"model":"test"}]}` {
+		t.Errorf("unexpected response %s", got)
+	}
+
+	calls := b.Object("system").Calls()
+	if len(calls) != 1 || calls[0].Args["verbose"] != int32(1) {
+		t.Errorf("integer arguments should stay integers, got %+v", calls)
+	}
+
+	got = post(t, server, `[{"jsonrpc":"2.0","id":2,"method":"call","params":["s","missing","board",{}]},{"jsonrpc":"2.0","id":3,"method":"call","params":["s","system","info"]}]`)
+	if got != `[{"jsonrpc":"2.0","id":2,"result":[4]},{"jsonrpc":"2.0","id":3,"result":[3]}]` {
+		t.Errorf("unexpected response %s", got)
+	}
+
+	got = post(t, server, `{"jsonrpc":"2.0","id":4,"method":"exec","params":["s"]}`)
+	if got != `{"jsonrpc":"2.0","id":4,"error":{"code":-32601,"message":"Method not found"}}` {
+		t.Errorf("unexpected response %s", got)
+	}
+
+	if got = post(t, server, `{"jsonrpc":`); !strings.Contains(got, `"code":-32700`) {
+		t.Errorf("expected parse error, got %s", got)
+	}
+}
+
+func TestGatewayList(t *testing.T) {
+	b, _, server := newTestGateway(t)
+
+	provider := b.NewClient(t)
+	obj := openwrt.UbusObject{Name: "network.interface.lan"}
+	obj.AddMethod("up", func(obj string, method string, req *openwrt.UbusRequestData, msg string) error {
+		return nil
+	}, openwrt.UbusMethodField{Name: "force", Type: openwrt.BLOBMSG_TYPE_BOOL})
+	provider.AddObject(&obj)
+	if err := provider.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := post(t, server, `{"jsonrpc":"2.0","id":1,"method":"list","params":["s","network.*"]}`)
+	if got != `{"jsonrpc":"2.0","id":1,"result":{"network.interface.lan":{"up":{"force":"boolean"}}}}` {
+		t.Errorf("unexpected response %s", got)
+	}
+}
+
+func TestGatewayAccess(t *testing.T) {
+	_, gateway, server := newTestGateway(t)
+
+	gateway.Access = func(r *http.Request, access *openwrt.UbusGatewayAccess) bool {
+		return access.Session == "admin" || access.Op == "list"
+	}
+
+	got := post(t, server, `{"jsonrpc":"2.0","id":1,"method":"call","params":["guest","system","board"]}`)
+	if got != `{"jsonrpc":"2.0","id":1,"error":{"code":-32002,"message":"Access denied"}}` {
+		t.Errorf("unexpected response %s", got)
+	}
+
+	got = post(t, server, `{"jsonrpc":"2.0","id":1,"method":"call","params":["admin","system","board"]}`)
+	if !strings.Contains(got, `"result":[0,`) {
+		t.Errorf("unexpected response %s", got)
+	}
+
+	resp, err := http.Get(server.URL + "/ubus/subscribe/test.*?sid=guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayEvents(t *testing.T) {
+	b, _, server := newTestGateway(t)
+
+	resp, err := http.Get(server.URL + "/ubus/subscribe/test.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	// the listener is registered once the headers are sent
+	sender := b.NewClient(t)
+	if err := sender.SendEvent("test.event", map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 4)
+	go func() {
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	if got := Wait(t, lines); got != "event: test.event" {
+		t.Errorf("unexpected line %s", got)
+	}
+	if got := Wait(t, lines); got != `data: {"n":1}` {
+		t.Errorf("unexpected line %s", got)
+	}
+}
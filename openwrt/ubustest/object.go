@@ -0,0 +1,214 @@
+package ubustest
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/hzwesoft-github/underscore/openwrt"
+)
+
+// answer a call with the reply, nil for none, and the status of the call.
+// args are the decoded arguments
+type Handler func(args map[string]any) (any, openwrt.UbusStatus)
+
+// a call made to an Object
+type Call struct {
+	Method string
+	Args   map[string]any
+}
+
+// an object served by the broker itself, see Broker.AddObject
+type Object struct {
+	Path string
+
+	broker *Broker
+	id     uint32
+
+	// guards the fields below
+	mutex    sync.Mutex
+	handlers map[string]Handler
+	calls    []Call
+}
+
+/*
+Add an object at path served by the broker, its methods are set with Reply,
+Fail or Handle. calls to other methods fail with UBUS_STATUS_METHOD_NOT_FOUND,
+all calls are recorded.
+
+panics when path is taken, like a test would with a duplicate fixture.
+*/
+func (b *Broker) AddObject(path string) *Object {
+	obj := &Object{
+		Path:     path,
+		broker:   b,
+		handlers: make(map[string]Handler),
+	}
+
+	var out _BrokerOutbox
+
+	b.mutex.Lock()
+	if b.objectByPath(path) != nil {
+		b.mutex.Unlock()
+		panic("ng: ubustest: object " + path + " exists")
+	}
+	o := &_BrokerObject{path: path, fake: obj}
+	b.register(&out, o)
+	obj.id = o.id
+	b.mutex.Unlock()
+
+	out.flush()
+
+	return obj
+}
+
+// the object added by AddObject at path, nil if there is none
+func (b *Broker) Object(path string) *Object {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if o := b.objectByPath(path); o != nil {
+		return o.fake
+	}
+
+	return nil
+}
+
+// answer method with reply, a json string or anything blobmsg can encode
+func (obj *Object) Reply(method string, reply any) *Object {
+	return obj.Handle(method, func(map[string]any) (any, openwrt.UbusStatus) {
+		return reply, openwrt.UBUS_STATUS_OK
+	})
+}
+
+// fail method with status
+func (obj *Object) Fail(method string, status openwrt.UbusStatus) *Object {
+	return obj.Handle(method, func(map[string]any) (any, openwrt.UbusStatus) {
+		return nil, status
+	})
+}
+
+func (obj *Object) Handle(method string, handler Handler) *Object {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+
+	obj.handlers[method] = handler
+	return obj
+}
+
+// the calls made so far, in order
+func (obj *Object) Calls() []Call {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+
+	return append([]Call(nil), obj.calls...)
+}
+
+// the calls of method made so far
+func (obj *Object) CallsTo(method string) []Call {
+	calls := make([]Call, 0)
+	for _, call := range obj.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// send a notification to the subscribers of the object
+func (obj *Object) Notify(typ string, msg any) error {
+	w := openwrt.NewBlobWriter()
+	if err := w.AddMessage(msg); err != nil {
+		return err
+	}
+
+	var out _BrokerOutbox
+
+	b := obj.broker
+	b.mutex.Lock()
+	o := b.objects[obj.id]
+	if o == nil {
+		b.mutex.Unlock()
+		return errors.New("ng: ubustest: object removed")
+	}
+	b.fanOut(&out, o, typ, w.Bytes(), 0, 0)
+	b.mutex.Unlock()
+
+	out.flush()
+
+	return nil
+}
+
+// number of objects subscribed to the object
+func (obj *Object) Subscribers() int {
+	b := obj.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if o := b.objects[obj.id]; o != nil {
+		return len(o.subscribers)
+	}
+
+	return 0
+}
+
+// remove the object, its subscribers are told
+func (obj *Object) Remove() {
+	var out _BrokerOutbox
+
+	b := obj.broker
+	b.mutex.Lock()
+	if o := b.objects[obj.id]; o != nil {
+		b.removeObject(&out, o)
+	}
+	b.mutex.Unlock()
+
+	out.flush()
+}
+
+func (obj *Object) call(method string, data []byte) ([]byte, openwrt.UbusStatus) {
+	args := make(map[string]any)
+	if err := openwrt.BlobmsgUnmarshal(data, &args); err != nil {
+		return nil, openwrt.UBUS_STATUS_INVALID_ARGUMENT
+	}
+
+	obj.mutex.Lock()
+	obj.calls = append(obj.calls, Call{Method: method, Args: args})
+	handler := obj.handlers[method]
+	obj.mutex.Unlock()
+
+	if handler == nil {
+		return nil, openwrt.UBUS_STATUS_METHOD_NOT_FOUND
+	}
+
+	reply, status := handler(args)
+	if reply == nil || status != openwrt.UBUS_STATUS_OK {
+		return nil, status
+	}
+
+	w := openwrt.NewBlobWriter()
+	if err := w.AddMessage(reply); err != nil {
+		return nil, openwrt.UBUS_STATUS_UNKNOWN_ERROR
+	}
+
+	return w.Bytes(), status
+}
+
+// a table per method without arguments, the broker knows no policies
+func (obj *Object) signature() []byte {
+	obj.mutex.Lock()
+	methods := make([]string, 0, len(obj.handlers))
+	for method := range obj.handlers {
+		methods = append(methods, method)
+	}
+	obj.mutex.Unlock()
+	sort.Strings(methods)
+
+	w := openwrt.NewBlobWriter()
+	for _, method := range methods {
+		w.Close(w.OpenTable(method))
+	}
+
+	return w.Bytes()
+}
@@ -1,6 +1,9 @@
+//go:build cgo
+
 package openwrt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -13,6 +16,9 @@ type UciClient struct {
 
 	shouldCommit  bool
 	externContext bool
+
+	auditSink  UciAuditSink
+	auditActor string
 }
 
 func NewUciClient(context *UciContext, packageName string) (*UciClient, error) {
@@ -27,7 +33,7 @@ func NewUciClient(context *UciContext, packageName string) (*UciClient, error) {
 		return nil, err
 	}
 
-	return &UciClient{context, pkg, false, externCtx}, nil
+	return &UciClient{Context: context, Package: pkg, externContext: externCtx}, nil
 }
 
 func (client *UciClient) Flush() error {
@@ -37,6 +43,13 @@ func (client *UciClient) Flush() error {
 	return client.Package.Commit(false)
 }
 
+func (client *UciClient) FlushContext(goCtx context.Context) error {
+	if !client.shouldCommit {
+		return nil
+	}
+	return client.Package.CommitContext(goCtx, false)
+}
+
 func (client *UciClient) Free() {
 	if !client.externContext {
 		defer client.Context.Free()
@@ -87,6 +100,10 @@ func (client *UciClient) Load(fragment *UciFragment) error {
 }
 
 func (client *UciClient) Exec(command UciCommand) error {
+	if client.auditSink != nil {
+		return client.execWithAudit(command)
+	}
+
 	return command.Exec(client)
 }
 
@@ -174,6 +191,90 @@ func (client *UciClient) QuerySection(cb SectionFilter) []UciSection {
 	return client.Package.QuerySection(cb)
 }
 
+// changes that Apply(data, mode) would make, nothing is written
+func (client *UciClient) Preview(data *UciPackageData, mode UciApplyMode) []UciChange {
+	current := client.Package.Export()
+	return PreviewUciData(current, data, mode)
+}
+
+func (client *UciClient) Apply(data *UciPackageData, mode UciApplyMode) ([]UciChange, error) {
+	if data.Name != "" && data.Name != client.Package.Name {
+		return nil, fmt.Errorf("ng: data of package %s can't be applied to %s", data.Name, client.Package.Name)
+	}
+
+	changes := client.Preview(data, mode)
+	return changes, client.ApplyChanges(changes)
+}
+
+func (client *UciClient) ApplyTemplate(tmpl *UciTemplate, vars map[string]any, mode UciApplyMode) ([]UciChange, error) {
+	data, err := tmpl.Render(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Apply(data, mode)
+}
+
+// execute changes as uci commands, so they are audited and committed on Flush
+func (client *UciClient) ApplyChanges(changes []UciChange) error {
+	for _, change := range changes {
+		if err := client.applyChange(&change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *UciClient) applyChange(change *UciChange) error {
+	switch change.Type {
+	case UCI_CHANGE_ADD_SECTION:
+		cmd := &UciCmd_AddSection{SectionName: change.Section, SectionType: change.SectionType}
+		if err := client.Exec(cmd); err != nil {
+			return err
+		}
+
+		for i := range change.Options {
+			if err := client.setOption(cmd.Section, &change.Options[i], false); err != nil {
+				return err
+			}
+		}
+	case UCI_CHANGE_DEL_SECTION:
+		return client.Exec(&UciCmd_DelSection{SectionName: change.Section})
+	case UCI_CHANGE_SET_OPTION, UCI_CHANGE_SET_LIST:
+		section := client.Package.LoadSection(change.Section)
+		if section == nil {
+			return fmt.Errorf("ng: section %s is not exist", change.Section)
+		}
+
+		return client.setOption(section, change.New, change.Old != nil)
+	case UCI_CHANGE_DEL_OPTION:
+		return client.Exec(&UciCmd_DelOption{SectionName: change.Section, OptionName: change.Option})
+	case UCI_CHANGE_ADD_LIST:
+		return client.Exec(&UciCmd_AddListOption{SectionName: change.Section, OptionName: change.Option, OptionValue: change.Value})
+	case UCI_CHANGE_DEL_FROM_LIST:
+		return client.Exec(&UciCmd_DelFromList{SectionName: change.Section, OptionName: change.Option, OptionValue: change.Value})
+	default:
+		return fmt.Errorf("ng: unknown change type %d", change.Type)
+	}
+
+	return nil
+}
+
+func (client *UciClient) setOption(section *UciSection, option *UciOptionData, exists bool) error {
+	if option.Type == UCI_TYPE_STRING {
+		return client.Exec(&UciCmd_SetOption{Section: section, OptionName: option.Name, OptionValue: option.Value})
+	}
+
+	if exists {
+		if err := client.Exec(&UciCmd_DelOption{Section: section, OptionName: option.Name}); err != nil {
+			return err
+		}
+	}
+
+	return client.Exec(&UciCmd_AddListOption{Section: section, OptionName: option.Name, OptionValues: option.Values})
+}
+
 type UciCommand interface {
 	Exec(client *UciClient) error
 }
@@ -262,7 +363,9 @@ func (c *UciCmd_SetOption) Exec(client *UciClient) error {
 		if section == nil {
 			return fmt.Errorf("ng: section %s is not exist", c.SectionName)
 		}
-		return section.SetStringOption(c.OptionName, c.OptionValue)
+		if err := section.SetStringOption(c.OptionName, c.OptionValue); err != nil {
+			return err
+		}
 	}
 
 	client.shouldCommit = true
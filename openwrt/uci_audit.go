@@ -0,0 +1,179 @@
+package openwrt
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/json"
+	"github.com/hzwesoft-github/underscore/log"
+)
+
+const (
+	UCI_AUDIT_ADD_SECTION   = "add_section"
+	UCI_AUDIT_DEL_SECTION   = "del_section"
+	UCI_AUDIT_SET_OPTION    = "set_option"
+	UCI_AUDIT_ADD_LIST      = "add_list"
+	UCI_AUDIT_DEL_OPTION    = "del_option"
+	UCI_AUDIT_DEL_FROM_LIST = "del_from_list"
+)
+
+// one executed UciCommand. a string option is recorded as a single value,
+// a section command records the section type as value, a missing option or
+// section as nil
+type UciAuditRecord struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Command  string    `json:"command"`
+	Package  string    `json:"package"`
+	Section  string    `json:"section"`
+	Option   string    `json:"option,omitempty"`
+	OldValue []string  `json:"old_value,omitempty"`
+	NewValue []string  `json:"new_value,omitempty"`
+}
+
+type UciAuditSink interface {
+	Write(record *UciAuditRecord) error
+}
+
+type UciAuditFunc func(record *UciAuditRecord) error
+
+func (f UciAuditFunc) Write(record *UciAuditRecord) error {
+	return f(record)
+}
+
+// * sinks
+
+// append-only json lines file
+type UciAuditFileSink struct {
+	Path string
+
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func NewUciAuditFileSink(path string) (*UciAuditFileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UciAuditFileSink{Path: path, file: file}, nil
+}
+
+func (sink *UciAuditFileSink) Write(record *UciAuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+func (sink *UciAuditFileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	return sink.file.Close()
+}
+
+// blank fields and zero times match any record
+type UciAuditFilter struct {
+	Package string
+	Section string
+	Option  string
+	Actor   string
+	Since   time.Time
+	Until   time.Time
+	// keep only the most recent records if positive
+	Limit int
+}
+
+func (filter *UciAuditFilter) Match(record *UciAuditRecord) bool {
+	if filter.Package != "" && filter.Package != record.Package {
+		return false
+	}
+	if filter.Section != "" && filter.Section != record.Section {
+		return false
+	}
+	if filter.Option != "" && filter.Option != record.Option {
+		return false
+	}
+	if filter.Actor != "" && filter.Actor != record.Actor {
+		return false
+	}
+	if !filter.Since.IsZero() && record.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && record.Time.After(filter.Until) {
+		return false
+	}
+
+	return true
+}
+
+func (sink *UciAuditFileSink) Query(filter UciAuditFilter) ([]UciAuditRecord, error) {
+	return QueryUciAuditFile(sink.Path, filter)
+}
+
+func QueryUciAuditFile(path string, filter UciAuditFilter) ([]UciAuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]UciAuditRecord, 0)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var record UciAuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, err
+		}
+
+		if !filter.Match(&record) {
+			continue
+		}
+
+		records = append(records, record)
+		if filter.Limit > 0 && len(records) > filter.Limit {
+			records = records[1:]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// write records through the log package, which forwards to syslog if configured
+type UciAuditLogSink struct {
+}
+
+func (sink *UciAuditLogSink) Write(record *UciAuditRecord) error {
+	log.GetLogger().WithFields(map[string]any{
+		"actor":     record.Actor,
+		"command":   record.Command,
+		"package":   record.Package,
+		"section":   record.Section,
+		"option":    record.Option,
+		"old_value": record.OldValue,
+		"new_value": record.NewValue,
+	}).Info("uci audit")
+
+	return nil
+}
@@ -0,0 +1,126 @@
+//go:build cgo
+
+package openwrt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hzwesoft-github/underscore/log"
+)
+
+// record every command executed by client.Exec to sink on behalf of actor,
+// a nil sink disables auditing. the command is applied before it is recorded,
+// so a failing sink is logged and doesn't fail Exec
+func (client *UciClient) SetAudit(sink UciAuditSink, actor string) {
+	client.auditSink = sink
+	client.auditActor = actor
+}
+
+func (client *UciClient) execWithAudit(command UciCommand) error {
+	record := &UciAuditRecord{
+		Actor:   client.auditActor,
+		Package: client.Package.Name,
+	}
+
+	section, option := _AuditTarget(client, command, record)
+	record.OldValue = _AuditValue(section, option)
+
+	if err := command.Exec(client); err != nil {
+		return err
+	}
+
+	switch c := command.(type) {
+	case *UciCmd_AddSection:
+		section = c.Section
+		if section != nil {
+			record.Section = section.Name
+		}
+	case *UciCmd_DelSection:
+		section = nil
+	default:
+		if section == nil {
+			section = client.Package.LoadSection(record.Section)
+		}
+	}
+
+	record.NewValue = _AuditValue(section, option)
+	record.Time = time.Now()
+
+	if err := client.auditSink.Write(record); err != nil {
+		log.GetLogger().WithFields(map[string]any{
+			"actor":   record.Actor,
+			"command": record.Command,
+			"package": record.Package,
+			"section": record.Section,
+			"option":  record.Option,
+			"error":   err.Error(),
+		}).Error("uci audit")
+	}
+
+	return nil
+}
+
+func _AuditTarget(client *UciClient, command UciCommand, record *UciAuditRecord) (section *UciSection, option string) {
+	var sectionName string
+
+	switch c := command.(type) {
+	case *UciCmd_AddSection:
+		record.Command = UCI_AUDIT_ADD_SECTION
+		record.Section = c.SectionName
+		return nil, ""
+	case *UciCmd_DelSection:
+		record.Command = UCI_AUDIT_DEL_SECTION
+		section, sectionName = c.Section, c.SectionName
+	case *UciCmd_SetOption:
+		record.Command = UCI_AUDIT_SET_OPTION
+		section, sectionName, option = c.Section, c.SectionName, c.OptionName
+	case *UciCmd_AddListOption:
+		record.Command = UCI_AUDIT_ADD_LIST
+		section, sectionName, option = c.Section, c.SectionName, c.OptionName
+	case *UciCmd_DelOption:
+		record.Command = UCI_AUDIT_DEL_OPTION
+		section, sectionName, option = c.Section, c.SectionName, c.OptionName
+	case *UciCmd_DelFromList:
+		record.Command = UCI_AUDIT_DEL_FROM_LIST
+		section, sectionName, option = c.Section, c.SectionName, c.OptionName
+	default:
+		record.Command = fmt.Sprintf("%T", command)
+		return nil, ""
+	}
+
+	if section == nil {
+		section = client.Package.LoadSection(sectionName)
+	}
+	if section != nil {
+		sectionName = section.Name
+	}
+
+	record.Section = sectionName
+	record.Option = option
+	return section, option
+}
+
+func _AuditValue(section *UciSection, option string) []string {
+	if section == nil {
+		return nil
+	}
+
+	if option == "" {
+		return []string{section.Type}
+	}
+
+	o := section.LoadOption(option)
+	if o == nil {
+		return nil
+	}
+
+	switch o.Type {
+	case UCI_TYPE_STRING:
+		return []string{o.Value}
+	case UCI_TYPE_LIST:
+		return o.Values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package openwrt
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testUciAuditRecords(base time.Time) []UciAuditRecord {
+	return []UciAuditRecord{
+		{Time: base, Actor: "root", Command: UCI_AUDIT_SET_OPTION, Package: "network", Section: "lan", Option: "ipaddr", NewValue: []string{"192.168.1.1"}},
+		{Time: base.Add(time.Minute), Actor: "admin", Command: UCI_AUDIT_ADD_LIST, Package: "network", Section: "lan", Option: "dns", NewValue: []string{"8.8.8.8"}},
+		{Time: base.Add(2 * time.Minute), Actor: "root", Command: UCI_AUDIT_ADD_SECTION, Package: "firewall", Section: "rule1", NewValue: []string{"rule"}},
+		{Time: base.Add(3 * time.Minute), Actor: "root", Command: UCI_AUDIT_DEL_OPTION, Package: "network", Section: "wan", Option: "proto", OldValue: []string{"dhcp"}},
+	}
+}
+
+func TestUciAuditFilter(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := &testUciAuditRecords(base)[0]
+
+	cases := []struct {
+		filter UciAuditFilter
+		match  bool
+	}{
+		{UciAuditFilter{}, true},
+		{UciAuditFilter{Package: "network", Section: "lan", Option: "ipaddr", Actor: "root"}, true},
+		{UciAuditFilter{Package: "firewall"}, false},
+		{UciAuditFilter{Section: "wan"}, false},
+		{UciAuditFilter{Option: "netmask"}, false},
+		{UciAuditFilter{Actor: "admin"}, false},
+		{UciAuditFilter{Since: base}, true},
+		{UciAuditFilter{Since: base.Add(time.Second)}, false},
+		{UciAuditFilter{Until: base}, true},
+		{UciAuditFilter{Until: base.Add(-time.Second)}, false},
+		{UciAuditFilter{Since: base.Add(-time.Second), Until: base.Add(time.Second)}, true},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.Match(record); got != c.match {
+			t.Errorf("%+v: expect %v, got %v", c.filter, c.match, got)
+		}
+	}
+}
+
+func TestUciAuditFileSink(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewUciAuditFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := testUciAuditRecords(base)
+	for i := range records {
+		if err := sink.Write(&records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer sink.Close()
+
+	cases := []struct {
+		filter UciAuditFilter
+		// indexes of the expected records
+		expect []int
+	}{
+		{UciAuditFilter{}, []int{0, 1, 2, 3}},
+		{UciAuditFilter{Package: "network"}, []int{0, 1, 3}},
+		{UciAuditFilter{Package: "network", Section: "lan"}, []int{0, 1}},
+		{UciAuditFilter{Actor: "root", Limit: 2}, []int{2, 3}},
+		{UciAuditFilter{Limit: 1}, []int{3}},
+		{UciAuditFilter{Since: base.Add(time.Minute)}, []int{1, 2, 3}},
+		{UciAuditFilter{Until: base.Add(time.Minute)}, []int{0, 1}},
+		{UciAuditFilter{Since: base.Add(time.Minute), Until: base.Add(2 * time.Minute)}, []int{1, 2}},
+		{UciAuditFilter{Package: "dhcp"}, []int{}},
+	}
+
+	for _, c := range cases {
+		got, err := sink.Query(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(c.expect) {
+			t.Errorf("%+v: expect %d records, got %+v", c.filter, len(c.expect), got)
+			continue
+		}
+		for i, index := range c.expect {
+			if !got[i].Time.Equal(records[index].Time) || got[i].Command != records[index].Command {
+				t.Errorf("%+v: expect record %d, got %+v", c.filter, index, got[i])
+			}
+		}
+	}
+
+	// the file survives the sink
+	got, err := QueryUciAuditFile(path, UciAuditFilter{Option: "proto"})
+	if err != nil || len(got) != 1 || got[0].OldValue[0] != "dhcp" {
+		t.Errorf("unexpected query result %+v %v", got, err)
+	}
+
+	if _, err := QueryUciAuditFile(filepath.Join(t.TempDir(), "missing.log"), UciAuditFilter{}); err == nil {
+		t.Error("expect error for a missing file")
+	}
+}
+
+func TestUciAuditFunc(t *testing.T) {
+	var written []*UciAuditRecord
+	var sink UciAuditSink = UciAuditFunc(func(record *UciAuditRecord) error {
+		written = append(written, record)
+		if record.Package == "" {
+			return errors.New("ng: no package")
+		}
+		return nil
+	})
+
+	record := &UciAuditRecord{Package: "network"}
+	if err := sink.Write(record); err != nil || len(written) != 1 || written[0] != record {
+		t.Errorf("unexpected write %v %v", written, err)
+	}
+	if err := sink.Write(&UciAuditRecord{}); err == nil {
+		t.Error("expect the error of the func")
+	}
+}
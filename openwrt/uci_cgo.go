@@ -90,8 +90,10 @@ static void option_list_value(struct uci_option *option, char ***list, int *list
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"reflect"
@@ -102,13 +104,6 @@ import (
 	"github.com/hzwesoft-github/underscore/lang"
 )
 
-type UciOptionType int
-
-const (
-	UCI_TYPE_STRING UciOptionType = iota
-	UCI_TYPE_LIST
-)
-
 const (
 	UCI_CONFIG_FOLDER = "/etc/config"
 )
@@ -299,6 +294,17 @@ func (pkg *UciPackage) Commit(overwrite bool) error {
 	return pkg.parent.uci_commit(pkg.ptr, overwrite)
 }
 
+// commit unless goCtx is done before the commit starts. uci_commit can't be
+// interrupted while it waits for the file lock, so once started it runs to the
+// end whatever goCtx does
+func (pkg *UciPackage) CommitContext(goCtx context.Context, overwrite bool) error {
+	if err := goCtx.Err(); err != nil {
+		return err
+	}
+
+	return pkg.Commit(overwrite)
+}
+
 func (pkg *UciPackage) LoadSection(name string) *UciSection {
 	csection := pkg.parent.uci_lookup_section(pkg.ptr, name)
 	if csection == nil {
@@ -384,6 +390,25 @@ func (pkg *UciPackage) ListSections() []UciSection {
 	return sections
 }
 
+// copy the package into memory, anonymous sections keep their generated names
+func (pkg *UciPackage) Export() *UciPackageData {
+	data := &UciPackageData{
+		Name:     pkg.Name,
+		Sections: make([]UciSectionData, 0),
+	}
+
+	for _, section := range pkg.ListSections() {
+		data.Sections = append(data.Sections, section.Export())
+	}
+
+	return data
+}
+
+// write the package as uci text, see WriteUci
+func (pkg *UciPackage) Write(w io.Writer) error {
+	return WriteUci(w, pkg.Export())
+}
+
 type SectionFilter func(section *UciSection) bool
 
 func (pkg *UciPackage) QuerySection(cb SectionFilter) []UciSection {
@@ -916,6 +941,31 @@ func (section *UciSection) LoadOption(name string) *UciOption {
 	return option
 }
 
+func (section *UciSection) Export() UciSectionData {
+	data := UciSectionData{
+		Name:      section.Name,
+		Type:      section.Type,
+		Anonymous: section.Anonymous,
+		Options:   make([]UciOptionData, 0),
+	}
+
+	for _, option := range section.ListOptions() {
+		data.Options = append(data.Options, UciOptionData{
+			Type:   option.Type,
+			Name:   option.Name,
+			Value:  option.Value,
+			Values: option.Values,
+		})
+	}
+
+	return data
+}
+
+func (section *UciSection) Write(w io.Writer) error {
+	data := section.Export()
+	return WriteUciSection(w, &data)
+}
+
 func (section *UciSection) SetStringOption(name string, value string) error {
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
@@ -0,0 +1,67 @@
+package openwrt
+
+import (
+	"fmt"
+	"strings"
+)
+
+type UciChangeType int
+
+const (
+	UCI_CHANGE_ADD_SECTION UciChangeType = iota
+	UCI_CHANGE_DEL_SECTION
+	UCI_CHANGE_SET_OPTION
+	UCI_CHANGE_DEL_OPTION
+	UCI_CHANGE_SET_LIST
+	UCI_CHANGE_ADD_LIST
+	UCI_CHANGE_DEL_FROM_LIST
+)
+
+// one step turning a package into another. Section is the name of the
+// section in the old package, blank for a new anonymous section. Options
+// are the options of an added section, Value the list item added or removed
+type UciChange struct {
+	Type        UciChangeType
+	Package     string
+	Section     string
+	SectionType string
+	Option      string
+	Old         *UciOptionData
+	New         *UciOptionData
+	Value       string
+	Options     []UciOptionData
+}
+
+// render change in the notation of `uci changes`
+func (change UciChange) String() string {
+	section := change.Package + "." + change.Section
+	if change.Section == "" {
+		section = change.Package + ".@" + change.SectionType + "[-1]"
+	}
+
+	switch change.Type {
+	case UCI_CHANGE_ADD_SECTION:
+		if change.Section == "" {
+			return "add " + change.Package + " " + change.SectionType
+		}
+		return "set " + section + "=" + change.SectionType
+	case UCI_CHANGE_DEL_SECTION:
+		return "delete " + section
+	case UCI_CHANGE_SET_OPTION:
+		return "set " + section + "." + change.Option + "=" + _QuoteUci(change.New.Value)
+	case UCI_CHANGE_DEL_OPTION:
+		return "delete " + section + "." + change.Option
+	case UCI_CHANGE_SET_LIST:
+		values := make([]string, 0, len(change.New.Values))
+		for _, v := range change.New.Values {
+			values = append(values, _QuoteUci(v))
+		}
+		return "set " + section + "." + change.Option + "=" + strings.Join(values, " ")
+	case UCI_CHANGE_ADD_LIST:
+		return "add_list " + section + "." + change.Option + "=" + _QuoteUci(change.Value)
+	case UCI_CHANGE_DEL_FROM_LIST:
+		return "del_list " + section + "." + change.Option + "=" + _QuoteUci(change.Value)
+	default:
+		return fmt.Sprintf("unknown change %d on %s", change.Type, section)
+	}
+}
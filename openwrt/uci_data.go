@@ -0,0 +1,242 @@
+package openwrt
+
+import (
+	"fmt"
+	"strings"
+)
+
+type UciOptionType int
+
+const (
+	UCI_TYPE_STRING UciOptionType = iota
+	UCI_TYPE_LIST
+)
+
+// in-memory copy of an uci package, detached from libuci. it is what
+// templates render to and what diffs are computed on
+type UciPackageData struct {
+	Name     string
+	Sections []UciSectionData
+}
+
+// Name is blank for an anonymous section that is not yet committed
+type UciSectionData struct {
+	Name      string
+	Type      string
+	Anonymous bool
+	Options   []UciOptionData
+}
+
+type UciOptionData struct {
+	Type   UciOptionType
+	Name   string
+	Value  string
+	Values []string
+}
+
+// * UciPackageData
+
+func (data *UciPackageData) Clone() *UciPackageData {
+	clone := &UciPackageData{
+		Name:     data.Name,
+		Sections: make([]UciSectionData, 0, len(data.Sections)),
+	}
+
+	for _, section := range data.Sections {
+		clone.Sections = append(clone.Sections, section.Clone())
+	}
+
+	return clone
+}
+
+func (data *UciPackageData) LoadSection(name string) *UciSectionData {
+	if name == "" {
+		return nil
+	}
+
+	for i := 0; i < len(data.Sections); i++ {
+		if data.Sections[i].Name == name {
+			return &data.Sections[i]
+		}
+	}
+
+	return nil
+}
+
+func (data *UciPackageData) QuerySection(cb func(section *UciSectionData) bool) []*UciSectionData {
+	result := make([]*UciSectionData, 0)
+	for i := 0; i < len(data.Sections); i++ {
+		if cb(&data.Sections[i]) {
+			result = append(result, &data.Sections[i])
+		}
+	}
+
+	return result
+}
+
+func (data *UciPackageData) AddSection(name string, typ string) *UciSectionData {
+	data.Sections = append(data.Sections, UciSectionData{
+		Name:      name,
+		Type:      typ,
+		Anonymous: name == "",
+	})
+
+	return &data.Sections[len(data.Sections)-1]
+}
+
+func (data *UciPackageData) DelSection(name string) {
+	for i := 0; i < len(data.Sections); i++ {
+		if data.Sections[i].Name == name {
+			data.Sections = append(data.Sections[:i], data.Sections[i+1:]...)
+			return
+		}
+	}
+}
+
+// check names and types the way libuci does before they are written
+func (data *UciPackageData) Validate() error {
+	if data.Name != "" && !_IsUciName(data.Name, true) {
+		return fmt.Errorf("ng: invalid package name %s", data.Name)
+	}
+
+	names := make(map[string]bool)
+	for _, section := range data.Sections {
+		if !_IsUciType(section.Type) {
+			return fmt.Errorf("ng: invalid section type %s", section.Type)
+		}
+
+		if section.Name != "" {
+			if !_IsUciName(section.Name, false) {
+				return fmt.Errorf("ng: invalid section name %s", section.Name)
+			}
+			if names[section.Name] {
+				return fmt.Errorf("ng: duplicate section %s", section.Name)
+			}
+			names[section.Name] = true
+		}
+
+		for _, option := range section.Options {
+			if !_IsUciName(option.Name, false) {
+				return fmt.Errorf("ng: invalid option name %s in section %s", option.Name, section.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// * UciSectionData
+
+func (section *UciSectionData) Clone() UciSectionData {
+	clone := *section
+	clone.Options = make([]UciOptionData, 0, len(section.Options))
+	for _, option := range section.Options {
+		clone.Options = append(clone.Options, option.Clone())
+	}
+
+	return clone
+}
+
+func (section *UciSectionData) LoadOption(name string) *UciOptionData {
+	for i := 0; i < len(section.Options); i++ {
+		if section.Options[i].Name == name {
+			return &section.Options[i]
+		}
+	}
+
+	return nil
+}
+
+func (section *UciSectionData) SetOption(option UciOptionData) {
+	if o := section.LoadOption(option.Name); o != nil {
+		*o = option.Clone()
+		return
+	}
+
+	section.Options = append(section.Options, option.Clone())
+}
+
+func (section *UciSectionData) SetStringOption(name string, value string) {
+	section.SetOption(UciOptionData{Type: UCI_TYPE_STRING, Name: name, Value: value})
+}
+
+func (section *UciSectionData) AddListOption(name string, values ...string) {
+	if o := section.LoadOption(name); o != nil && o.Type == UCI_TYPE_LIST {
+		o.Values = append(o.Values, values...)
+		return
+	}
+
+	section.SetOption(UciOptionData{Type: UCI_TYPE_LIST, Name: name, Values: values})
+}
+
+func (section *UciSectionData) DelOption(name string) {
+	for i := 0; i < len(section.Options); i++ {
+		if section.Options[i].Name == name {
+			section.Options = append(section.Options[:i], section.Options[i+1:]...)
+			return
+		}
+	}
+}
+
+// * UciOptionData
+
+func (option *UciOptionData) Clone() UciOptionData {
+	clone := *option
+	if option.Values != nil {
+		clone.Values = append(make([]string, 0, len(option.Values)), option.Values...)
+	}
+
+	return clone
+}
+
+func (option *UciOptionData) Equals(other *UciOptionData) bool {
+	if option == nil || other == nil {
+		return option == other
+	}
+	if option.Type != other.Type || option.Name != other.Name {
+		return false
+	}
+
+	switch option.Type {
+	case UCI_TYPE_STRING:
+		return option.Value == other.Value
+	case UCI_TYPE_LIST:
+		if len(option.Values) != len(other.Values) {
+			return false
+		}
+		for i := range option.Values {
+			if option.Values[i] != other.Values[i] {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func _IsUciName(name string, pkg bool) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			continue
+		}
+		if pkg && c == '-' {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+func _IsUciType(typ string) bool {
+	if typ == "" {
+		return false
+	}
+
+	return !strings.ContainsAny(typ, " \t\r\n'\"\\#")
+}
@@ -0,0 +1,220 @@
+package openwrt
+
+import (
+	"fmt"
+
+	"github.com/hzwesoft-github/underscore/lang"
+)
+
+type UciDiffOptions struct {
+	// section type to the option that identifies anonymous sections of that
+	// type, e.g. "rule": "name" for firewall. sections without a key option
+	// are matched by type and index
+	KeyOptions map[string]string
+}
+
+// compute changes turning old into new. named sections are matched by name,
+// anonymous sections by type and index among the anonymous sections of that type
+func DiffUciPackage(old, new *UciPackageData) []UciChange {
+	return DiffUciPackageWithOptions(old, new, nil)
+}
+
+// same as DiffUciPackage, anonymous sections are matched by key option first.
+// opts may be nil
+func DiffUciPackageWithOptions(old, new *UciPackageData, opts *UciDiffOptions) []UciChange {
+	changes := make([]UciChange, 0)
+	matches := _MatchUciSectionsWithOptions(old.Sections, new.Sections, opts)
+
+	matched := make(map[int]bool)
+	for _, i := range matches {
+		matched[i] = true
+	}
+
+	for i, section := range old.Sections {
+		if !matched[i] {
+			changes = append(changes, UciChange{
+				Type:        UCI_CHANGE_DEL_SECTION,
+				Package:     old.Name,
+				Section:     section.Name,
+				SectionType: section.Type,
+			})
+		}
+	}
+
+	for j := range new.Sections {
+		section := &new.Sections[j]
+
+		i, ok := matches[j]
+		if ok && old.Sections[i].Type == section.Type {
+			changes = append(changes, _DiffUciOptions(old.Name, &old.Sections[i], section)...)
+			continue
+		}
+
+		if ok {
+			changes = append(changes, UciChange{
+				Type:        UCI_CHANGE_DEL_SECTION,
+				Package:     old.Name,
+				Section:     old.Sections[i].Name,
+				SectionType: old.Sections[i].Type,
+			})
+		}
+
+		changes = append(changes, UciChange{
+			Type:        UCI_CHANGE_ADD_SECTION,
+			Package:     old.Name,
+			Section:     section.Name,
+			SectionType: section.Type,
+			Options:     section.Clone().Options,
+		})
+	}
+
+	return changes
+}
+
+func _DiffUciOptions(pkg string, old, new *UciSectionData) []UciChange {
+	changes := make([]UciChange, 0)
+
+	for i := range old.Options {
+		option := &old.Options[i]
+		if new.LoadOption(option.Name) == nil {
+			changes = append(changes, UciChange{
+				Type:        UCI_CHANGE_DEL_OPTION,
+				Package:     pkg,
+				Section:     old.Name,
+				SectionType: old.Type,
+				Option:      option.Name,
+				Old:         option,
+			})
+		}
+	}
+
+	for i := range new.Options {
+		option := &new.Options[i]
+		oldOption := old.LoadOption(option.Name)
+		if oldOption.Equals(option) {
+			continue
+		}
+
+		if listChanges := _DiffUciList(pkg, old, oldOption, option); listChanges != nil {
+			changes = append(changes, listChanges...)
+			continue
+		}
+
+		changes = append(changes, UciChange{
+			Type:        lang.TernaryOperator(option.Type == UCI_TYPE_LIST, UCI_CHANGE_SET_LIST, UCI_CHANGE_SET_OPTION),
+			Package:     pkg,
+			Section:     old.Name,
+			SectionType: old.Type,
+			Option:      option.Name,
+			Old:         oldOption,
+			New:         option,
+		})
+	}
+
+	return changes
+}
+
+// list items removed and added, nil if the lists can't be turned into each
+// other that way (e.g. reordered) and must be replaced as a whole
+func _DiffUciList(pkg string, section *UciSectionData, old, new *UciOptionData) []UciChange {
+	if old == nil || old.Type != UCI_TYPE_LIST || new.Type != UCI_TYPE_LIST {
+		return nil
+	}
+
+	newValues := lang.NewSet[string]()
+	for _, v := range new.Values {
+		lang.AddToSet(newValues, v)
+	}
+
+	changes := make([]UciChange, 0)
+	removed := lang.NewSet[string]()
+	remaining := make([]string, 0)
+	for _, v := range old.Values {
+		if newValues[v] {
+			remaining = append(remaining, v)
+			continue
+		}
+		if !removed[v] {
+			lang.AddToSet(removed, v)
+			changes = append(changes, UciChange{
+				Type:        UCI_CHANGE_DEL_FROM_LIST,
+				Package:     pkg,
+				Section:     section.Name,
+				SectionType: section.Type,
+				Option:      new.Name,
+				Value:       v,
+			})
+		}
+	}
+
+	if len(remaining) == 0 {
+		return nil
+	}
+	for i := 0; i < len(remaining); i++ {
+		if i >= len(new.Values) || remaining[i] != new.Values[i] {
+			return nil
+		}
+	}
+
+	for _, v := range new.Values[len(remaining):] {
+		changes = append(changes, UciChange{
+			Type:        UCI_CHANGE_ADD_LIST,
+			Package:     pkg,
+			Section:     section.Name,
+			SectionType: section.Type,
+			Option:      new.Name,
+			Value:       v,
+		})
+	}
+
+	return changes
+}
+
+// identify each section: the name of named sections, key option or type and
+// index of anonymous ones
+func _UciSectionKeys(sections []UciSectionData, opts *UciDiffOptions) []string {
+	keys := make([]string, 0, len(sections))
+	counters := make(map[string]int)
+
+	for _, section := range sections {
+		if !section.Anonymous {
+			keys = append(keys, section.Name)
+			continue
+		}
+
+		if opts != nil && opts.KeyOptions != nil {
+			if name, ok := opts.KeyOptions[section.Type]; ok {
+				if option := section.LoadOption(name); option != nil && option.Type == UCI_TYPE_STRING {
+					keys = append(keys, fmt.Sprintf("@%s[%s=%s]", section.Type, name, option.Value))
+					continue
+				}
+			}
+		}
+
+		keys = append(keys, fmt.Sprintf("@%s[%d]", section.Type, counters[section.Type]))
+		counters[section.Type]++
+	}
+
+	return keys
+}
+
+// same as _MatchUciSections, anonymous sections are matched by key option first
+func _MatchUciSectionsWithOptions(a, b []UciSectionData, opts *UciDiffOptions) map[int]int {
+	matches := make(map[int]int)
+
+	indexes := make(map[string]int)
+	for i, key := range _UciSectionKeys(a, opts) {
+		if _, ok := indexes[key]; !ok {
+			indexes[key] = i
+		}
+	}
+
+	for j, key := range _UciSectionKeys(b, opts) {
+		if i, ok := indexes[key]; ok {
+			matches[j] = i
+			delete(indexes, key)
+		}
+	}
+
+	return matches
+}
@@ -0,0 +1,111 @@
+package openwrt
+
+import (
+	"testing"
+)
+
+const testFirewallBase = `
+config defaults
+	option input 'ACCEPT'
+
+config rule
+	option name 'Allow-DHCP'
+	option proto 'udp'
+	list icmp_type 'echo-request'
+
+config rule
+	option name 'Allow-Ping'
+	option proto 'icmp'
+`
+
+func TestDiffUciPackage(t *testing.T) {
+	old, _ := ParseUciString("firewall", testFirewallBase)
+	new, _ := ParseUciString("firewall", `
+config defaults
+	option input 'REJECT'
+
+config rule
+	option name 'Allow-Ping'
+	option proto 'icmp'
+
+config rule
+	option name 'Allow-DHCP'
+	option proto 'udp'
+	list icmp_type 'echo-request'
+	list icmp_type 'echo-reply'
+`)
+
+	// by index the two rules swap their options
+	changes := DiffUciPackage(old, new)
+	if len(changes) != 7 {
+		t.Errorf("expect 7 changes matching by index, got %v", changes)
+	}
+
+	// by name only the option and the list item differ
+	changes = DiffUciPackageWithOptions(old, new, &UciDiffOptions{KeyOptions: map[string]string{"rule": "name"}})
+	if len(changes) != 2 {
+		t.Fatalf("expect 2 changes matching by key, got %v", changes)
+	}
+	if changes[0].Type != UCI_CHANGE_SET_OPTION || changes[1].Type != UCI_CHANGE_ADD_LIST || changes[1].Value != "echo-reply" {
+		t.Errorf("unexpected changes %v", changes)
+	}
+}
+
+func TestMergeUciPackage(t *testing.T) {
+	opts := &UciDiffOptions{KeyOptions: map[string]string{"rule": "name"}}
+
+	base, _ := ParseUciString("firewall", testFirewallBase)
+	local, _ := ParseUciString("firewall", `
+config defaults
+	option input 'REJECT'
+
+config rule
+	option name 'Allow-DHCP'
+	option proto 'udp'
+	list icmp_type 'echo-request'
+	list icmp_type 'echo-reply'
+
+config rule
+	option name 'Allow-Ping'
+	option proto 'tcp'
+`)
+	remote, _ := ParseUciString("firewall", `
+config defaults
+	option input 'ACCEPT'
+	option output 'ACCEPT'
+
+config rule
+	option name 'Allow-DHCP'
+	option proto 'udp'
+	list icmp_type 'echo-request'
+	list icmp_type 'time-exceeded'
+
+config rule
+	option name 'Allow-Ping'
+	option proto 'udp'
+
+config rule
+	option name 'Allow-IGMP'
+	option proto 'igmp'
+`)
+
+	result, conflicts := MergeUciPackage(base, local, remote, opts)
+
+	if len(conflicts) != 1 || conflicts[0].Option != "proto" {
+		t.Errorf("expect conflict on proto, got %v", conflicts)
+	}
+	if len(result.Sections) != 4 {
+		t.Fatalf("expect 4 sections, got %+v", result.Sections)
+	}
+
+	defaults := result.Sections[0]
+	if defaults.LoadOption("input").Value != "REJECT" || defaults.LoadOption("output") == nil {
+		t.Errorf("unexpected defaults %+v", defaults)
+	}
+	if icmp := result.Sections[1].LoadOption("icmp_type"); len(icmp.Values) != 3 {
+		t.Errorf("expect merged list, got %v", icmp.Values)
+	}
+	if result.Sections[2].LoadOption("proto").Value != "tcp" {
+		t.Errorf("expect local value kept on conflict")
+	}
+}
@@ -0,0 +1,238 @@
+package openwrt
+
+import (
+	"fmt"
+)
+
+// a change made on both sides of a three-way merge that can't be combined.
+// Option is blank for a conflict on the section itself
+type UciConflict struct {
+	Section     string
+	SectionType string
+	Option      string
+	Reason      string
+	Base        *UciOptionData
+	Local       *UciOptionData
+	Remote      *UciOptionData
+}
+
+func (c UciConflict) String() string {
+	if c.Option == "" {
+		return fmt.Sprintf("%s(%s): %s", c.Section, c.SectionType, c.Reason)
+	}
+
+	return fmt.Sprintf("%s(%s).%s: %s", c.Section, c.SectionType, c.Option, c.Reason)
+}
+
+func DiffUciFile(oldFile, newFile string, opts *UciDiffOptions) ([]UciChange, error) {
+	old, err := ParseUciFile(oldFile)
+	if err != nil {
+		return nil, err
+	}
+
+	new, err := ParseUciFile(newFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffUciPackageWithOptions(old, new, opts), nil
+}
+
+/*
+Merge the changes made from base to local and from base to remote, e.g. local
+edits and the defaults of an upgraded firmware. sections are matched the same
+way as DiffUciPackage. lists changed on both sides are merged item by item.
+
+the result keeps the order of local, with sections added by remote appended.
+on conflict the local side is kept and the conflict reported.
+*/
+func MergeUciPackage(base, local, remote *UciPackageData, opts *UciDiffOptions) (*UciPackageData, []UciConflict) {
+	conflicts := make([]UciConflict, 0)
+	result := &UciPackageData{
+		Name:     local.Name,
+		Sections: make([]UciSectionData, 0),
+	}
+
+	baseSections := _IndexUciSections(base.Sections, opts)
+	remoteSections := _IndexUciSections(remote.Sections, opts)
+	localKeys := _UciSectionKeys(local.Sections, opts)
+
+	for i, key := range localKeys {
+		l := &local.Sections[i]
+		b, r := baseSections[key], remoteSections[key]
+
+		switch {
+		case b == nil && r == nil:
+			// added locally
+			result.Sections = append(result.Sections, l.Clone())
+		case b != nil && r == nil:
+			// deleted upstream
+			if len(_DiffUciOptions("", b, l)) == 0 && b.Type == l.Type {
+				continue
+			}
+			result.Sections = append(result.Sections, l.Clone())
+			conflicts = append(conflicts, UciConflict{Section: l.Name, SectionType: l.Type, Reason: "modified locally, deleted upstream"})
+		default:
+			section, sectionConflicts := _MergeUciSection(b, l, r)
+			result.Sections = append(result.Sections, section)
+			conflicts = append(conflicts, sectionConflicts...)
+		}
+	}
+
+	localSections := _IndexUciSections(local.Sections, opts)
+	for j, key := range _UciSectionKeys(remote.Sections, opts) {
+		if localSections[key] != nil {
+			continue
+		}
+
+		r := &remote.Sections[j]
+		b := baseSections[key]
+
+		switch {
+		case b == nil:
+			// added upstream
+			section := r.Clone()
+			if section.Anonymous {
+				section.Name = ""
+			}
+			result.Sections = append(result.Sections, section)
+		case len(_DiffUciOptions("", b, r)) != 0 || b.Type != r.Type:
+			conflicts = append(conflicts, UciConflict{Section: r.Name, SectionType: r.Type, Reason: "deleted locally, modified upstream"})
+		}
+	}
+
+	return result, conflicts
+}
+
+func MergeUciFile(baseFile, localFile, remoteFile string, opts *UciDiffOptions) (*UciPackageData, []UciConflict, error) {
+	packages := make([]*UciPackageData, 0, 3)
+	for _, file := range []string{baseFile, localFile, remoteFile} {
+		data, err := ParseUciFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		packages = append(packages, data)
+	}
+
+	result, conflicts := MergeUciPackage(packages[0], packages[1], packages[2], opts)
+	return result, conflicts, nil
+}
+
+func _IndexUciSections(sections []UciSectionData, opts *UciDiffOptions) map[string]*UciSectionData {
+	index := make(map[string]*UciSectionData)
+	for i, key := range _UciSectionKeys(sections, opts) {
+		if _, ok := index[key]; !ok {
+			index[key] = &sections[i]
+		}
+	}
+
+	return index
+}
+
+// merge one section present locally and upstream, base is nil if it was added on both sides
+func _MergeUciSection(base, local, remote *UciSectionData) (UciSectionData, []UciConflict) {
+	conflicts := make([]UciConflict, 0)
+	result := local.Clone()
+
+	if base == nil {
+		base = &UciSectionData{Name: local.Name, Type: local.Type, Anonymous: local.Anonymous}
+	}
+
+	if local.Type != remote.Type {
+		if local.Type == base.Type {
+			result.Type = remote.Type
+		} else if remote.Type != base.Type {
+			conflicts = append(conflicts, UciConflict{
+				Section:     local.Name,
+				SectionType: local.Type,
+				Reason:      fmt.Sprintf("type changed to %s locally and %s upstream", local.Type, remote.Type),
+			})
+		}
+	}
+
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, options := range [][]UciOptionData{local.Options, remote.Options, base.Options} {
+		for _, option := range options {
+			if !seen[option.Name] {
+				seen[option.Name] = true
+				names = append(names, option.Name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		b, l, r := base.LoadOption(name), local.LoadOption(name), remote.LoadOption(name)
+
+		switch {
+		case l.Equals(r), r.Equals(b):
+			// nothing changed upstream
+		case l.Equals(b):
+			if r == nil {
+				result.DelOption(name)
+			} else {
+				result.SetOption(*r)
+			}
+		default:
+			if merged := _MergeUciList(b, l, r); merged != nil {
+				result.SetOption(*merged)
+				continue
+			}
+
+			conflicts = append(conflicts, UciConflict{
+				Section:     local.Name,
+				SectionType: local.Type,
+				Option:      name,
+				Reason:      "changed locally and upstream",
+				Base:        b,
+				Local:       l,
+				Remote:      r,
+			})
+		}
+	}
+
+	return result, conflicts
+}
+
+// apply the items removed and added upstream to the local list, nil if
+// any side is not a list
+func _MergeUciList(base, local, remote *UciOptionData) *UciOptionData {
+	if local == nil || remote == nil || local.Type != UCI_TYPE_LIST || remote.Type != UCI_TYPE_LIST {
+		return nil
+	}
+	if base != nil && base.Type != UCI_TYPE_LIST {
+		return nil
+	}
+
+	var baseValues []string
+	if base != nil {
+		baseValues = base.Values
+	}
+
+	contains := func(values []string, value string) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	merged := local.Clone()
+	merged.Values = make([]string, 0, len(local.Values))
+	for _, v := range local.Values {
+		if contains(baseValues, v) && !contains(remote.Values, v) {
+			continue
+		}
+		merged.Values = append(merged.Values, v)
+	}
+
+	for _, v := range remote.Values {
+		if !contains(baseValues, v) && !contains(merged.Values, v) {
+			merged.Values = append(merged.Values, v)
+		}
+	}
+
+	return &merged
+}
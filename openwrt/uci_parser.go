@@ -0,0 +1,205 @@
+package openwrt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// parse uci text (the format of files in /etc/config) without libuci.
+// name is used as package name unless the text declares one
+func ParseUci(name string, r io.Reader) (*UciPackageData, error) {
+	text, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseUciString(name, string(text))
+}
+
+func ParseUciFile(file string) (*UciPackageData, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseUci(path.Base(file), f)
+}
+
+func ParseUciString(name string, text string) (*UciPackageData, error) {
+	statements, err := _TokenizeUci(text)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &UciPackageData{
+		Name:     name,
+		Sections: make([]UciSectionData, 0),
+	}
+
+	var section *UciSectionData
+	for _, stmt := range statements {
+		keyword, args := stmt.tokens[0], stmt.tokens[1:]
+
+		switch keyword {
+		case "package":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("ng: line %d: package expects a name", stmt.line)
+			}
+			data.Name = args[0]
+		case "config":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("ng: line %d: config expects a type and an optional name", stmt.line)
+			}
+
+			var sectionName string
+			if len(args) == 2 {
+				sectionName = args[1]
+			}
+
+			if section = data.LoadSection(sectionName); section != nil {
+				section.Type = args[0]
+			} else {
+				section = data.AddSection(sectionName, args[0])
+			}
+		case "option", "list":
+			if section == nil {
+				return nil, fmt.Errorf("ng: line %d: %s outside of a config section", stmt.line, keyword)
+			}
+			if len(args) != 2 {
+				return nil, fmt.Errorf("ng: line %d: %s expects a name and a value", stmt.line, keyword)
+			}
+
+			if keyword == "option" {
+				section.SetStringOption(args[0], args[1])
+				continue
+			}
+
+			// like libuci, a list statement turns an existing option into a list
+			if o := section.LoadOption(args[0]); o != nil && o.Type == UCI_TYPE_STRING {
+				section.SetOption(UciOptionData{Type: UCI_TYPE_LIST, Name: args[0], Values: []string{o.Value, args[1]}})
+			} else {
+				section.AddListOption(args[0], args[1])
+			}
+		default:
+			return nil, fmt.Errorf("ng: line %d: unknown keyword %s", stmt.line, keyword)
+		}
+	}
+
+	return data, nil
+}
+
+type _UciStatement struct {
+	line   int
+	tokens []string
+}
+
+// split text into statements of tokens, handling quotes, escapes, comments
+// and line continuation the same way as libuci
+func _TokenizeUci(text string) ([]_UciStatement, error) {
+	statements := make([]_UciStatement, 0)
+
+	var token strings.Builder
+	var tokens []string
+	inToken := false
+	line, stmtLine := 1, 1
+
+	endToken := func() {
+		if inToken {
+			tokens = append(tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+	endStatement := func() {
+		endToken()
+		if len(tokens) > 0 {
+			statements = append(statements, _UciStatement{stmtLine, tokens})
+			tokens = nil
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		if !inToken && len(tokens) == 0 {
+			stmtLine = line
+		}
+
+		switch c {
+		case '\n':
+			endStatement()
+			line++
+		case ' ', '\t', '\r':
+			endToken()
+		case '#':
+			if inToken {
+				token.WriteByte(c)
+				continue
+			}
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			i--
+		case '\\':
+			if i+1 >= len(text) {
+				return nil, fmt.Errorf("ng: line %d: unterminated escape", line)
+			}
+			i++
+			if text[i] == '\n' {
+				line++
+				continue
+			}
+			token.WriteByte(text[i])
+			inToken = true
+		case '\'':
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("ng: line %d: unterminated quote", line)
+			}
+			quoted := text[i+1 : i+1+end]
+			token.WriteString(quoted)
+			line += strings.Count(quoted, "\n")
+			i += end + 1
+			inToken = true
+		case '"':
+			closed := false
+			for i++; i < len(text); i++ {
+				if text[i] == '"' {
+					closed = true
+					break
+				}
+				if text[i] == '\n' {
+					line++
+				}
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+					if text[i] == '\n' {
+						line++
+						continue
+					}
+				}
+				token.WriteByte(text[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("ng: line %d: unterminated quote", line)
+			}
+			inToken = true
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+
+	endStatement()
+
+	return statements, nil
+}
+
+// quote value for uci text, embedded single quotes are closed, escaped and reopened
+func _QuoteUci(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,159 @@
+package openwrt
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var (
+	uciVariablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_.]*)\}`)
+)
+
+/*
+Template of an uci package. the text is executed as a go text/template with
+the device variables as dot, then ${name} placeholders are replaced by the
+variable of the same name. a missing variable is an error in both steps.
+
+variables are inserted as is, use the quote function inside {{ }} for values
+that may contain quotes or whitespace:
+
+	config wifi-iface 'default_radio0'
+		option ssid {{ quote .ssid }}
+		option key '${psk}'
+*/
+type UciTemplate struct {
+	Name string
+	// called with the rendered package after syntax and name validation
+	Validator func(data *UciPackageData) error
+
+	tmpl *template.Template
+}
+
+func NewUciTemplate(name string, text string) (*UciTemplate, error) {
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"quote": _QuoteUci}).
+		Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UciTemplate{Name: name, tmpl: tmpl}, nil
+}
+
+func LoadUciTemplate(file string) (*UciTemplate, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewUciTemplate(path.Base(file), string(text))
+}
+
+// render the template to uci text without parsing it
+func (t *UciTemplate) RenderText(vars map[string]any) (string, error) {
+	var builder strings.Builder
+	if err := t.tmpl.Execute(&builder, vars); err != nil {
+		return "", err
+	}
+
+	var missing []string
+	text := uciVariablePattern.ReplaceAllStringFunc(builder.String(), func(placeholder string) string {
+		name := placeholder[2 : len(placeholder)-1]
+
+		value, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+			return placeholder
+		}
+
+		return fmt.Sprint(value)
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("ng: template %s: missing variables %s", t.Name, strings.Join(missing, ", "))
+	}
+
+	return text, nil
+}
+
+// render, parse and validate the template
+func (t *UciTemplate) Render(vars map[string]any) (*UciPackageData, error) {
+	text, err := t.RenderText(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ParseUciString(t.Name, text)
+	if err != nil {
+		return nil, fmt.Errorf("ng: template %s: %w", t.Name, err)
+	}
+
+	if err := data.Validate(); err != nil {
+		return nil, fmt.Errorf("ng: template %s: %w", t.Name, err)
+	}
+
+	if t.Validator != nil {
+		if err := t.Validator(data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+type UciApplyMode int
+
+const (
+	// sections of the data are added or their options overwritten, everything else is kept
+	UCI_APPLY_MERGE UciApplyMode = iota
+	// the package ends up with exactly the sections of the data
+	UCI_APPLY_REPLACE
+)
+
+// the package current turns into when data is applied in mode
+func MergeUciData(current, data *UciPackageData, mode UciApplyMode) *UciPackageData {
+	if mode == UCI_APPLY_REPLACE {
+		target := data.Clone()
+		target.Name = current.Name
+		return target
+	}
+
+	target := current.Clone()
+	matches := _MatchUciSections(target.Sections, data.Sections)
+
+	for j := range data.Sections {
+		section := &data.Sections[j]
+
+		i, ok := matches[j]
+		if !ok {
+			target.Sections = append(target.Sections, section.Clone())
+			continue
+		}
+
+		if target.Sections[i].Type != section.Type {
+			target.Sections[i] = section.Clone()
+			continue
+		}
+
+		for _, option := range section.Options {
+			target.Sections[i].SetOption(option)
+		}
+	}
+
+	return target
+}
+
+// the changes applying data to current in mode makes, see UciClient.Preview
+func PreviewUciData(current, data *UciPackageData, mode UciApplyMode) []UciChange {
+	return DiffUciPackage(current, MergeUciData(current, data, mode))
+}
+
+// map index in b to the index of the matching section in a
+func _MatchUciSections(a, b []UciSectionData) map[int]int {
+	return _MatchUciSectionsWithOptions(a, b, nil)
+}
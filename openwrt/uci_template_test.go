@@ -0,0 +1,131 @@
+package openwrt
+
+import (
+	"testing"
+)
+
+const testNetworkTemplate = `
+config interface 'lan'
+	option proto 'static'
+	option ipaddr '${lan_ip}'
+	option netmask '255.255.255.0'
+
+config interface 'wan'
+	option proto {{ quote .wan_proto }}
+{{- range .dns }}
+	list dns '{{ . }}'
+{{- end }}
+
+config route
+	option target '${route}'
+`
+
+func TestParseUci(t *testing.T) {
+	data, err := ParseUciString("network", `
+package 'network'
+
+# comment
+config interface "lan" # trailing comment
+	option ipaddr 192.168.1.1
+	option desc 'it'\''s "lan"'
+	list ports eth0
+	list ports 'eth1'
+
+config device
+	option name br-lan
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data.Sections) != 2 {
+		t.Fatalf("expect 2 sections, got %d", len(data.Sections))
+	}
+
+	lan := data.LoadSection("lan")
+	if lan == nil || lan.Type != "interface" {
+		t.Fatalf("section lan not parsed: %+v", data.Sections)
+	}
+	if o := lan.LoadOption("desc"); o == nil || o.Value != `it's "lan"` {
+		t.Errorf("unexpected desc %+v", o)
+	}
+	if o := lan.LoadOption("ports"); o == nil || o.Type != UCI_TYPE_LIST || len(o.Values) != 2 {
+		t.Errorf("unexpected ports %+v", o)
+	}
+	if !data.Sections[1].Anonymous || data.Sections[1].Type != "device" {
+		t.Errorf("unexpected anonymous section %+v", data.Sections[1])
+	}
+
+	if _, err := ParseUciString("network", "option ipaddr 1.1.1.1"); err == nil {
+		t.Error("expect error for option outside of section")
+	}
+	if _, err := ParseUciString("network", "config interface 'lan"); err == nil {
+		t.Error("expect error for unterminated quote")
+	}
+}
+
+func TestRenderUciTemplate(t *testing.T) {
+	tmpl, err := NewUciTemplate("network", testNetworkTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]any{
+		"lan_ip":    "10.0.0.1",
+		"wan_proto": "dhcp",
+		"dns":       []string{"8.8.8.8", "1.1.1.1"},
+		"route":     "10.1.0.0/16",
+	}
+
+	data, err := tmpl.Render(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o := data.LoadSection("lan").LoadOption("ipaddr"); o.Value != "10.0.0.1" {
+		t.Errorf("unexpected ipaddr %s", o.Value)
+	}
+	if o := data.LoadSection("wan").LoadOption("dns"); len(o.Values) != 2 {
+		t.Errorf("unexpected dns %v", o.Values)
+	}
+
+	delete(vars, "route")
+	if _, err := tmpl.Render(vars); err == nil {
+		t.Error("expect error for missing variable")
+	}
+}
+
+func TestMergeUciData(t *testing.T) {
+	current, _ := ParseUciString("network", `
+config interface 'lan'
+	option proto 'static'
+	option ipaddr '192.168.1.1'
+
+config interface 'guest'
+	option proto 'static'
+
+config route
+	option target '10.0.0.0/8'
+`)
+	data, _ := ParseUciString("network", `
+config interface 'lan'
+	option ipaddr '10.0.0.1'
+
+config route
+	option target '10.1.0.0/16'
+`)
+
+	changes := PreviewUciData(current, data, UCI_APPLY_MERGE)
+	if len(changes) != 2 {
+		t.Fatalf("expect 2 changes in merge mode, got %v", changes)
+	}
+
+	changes = PreviewUciData(current, data, UCI_APPLY_REPLACE)
+	types := make(map[UciChangeType]int)
+	for _, change := range changes {
+		types[change.Type]++
+	}
+	if types[UCI_CHANGE_DEL_SECTION] != 1 || types[UCI_CHANGE_DEL_OPTION] != 1 || types[UCI_CHANGE_SET_OPTION] != 2 {
+		t.Errorf("unexpected changes in replace mode %v", changes)
+	}
+}
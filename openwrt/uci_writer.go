@@ -0,0 +1,98 @@
+package openwrt
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+)
+
+// write data in the format of files in /etc/config: one tab of indentation,
+// section names and values single quoted, section types and option names bare,
+// a blank line between sections.
+// anonymous sections are written without their generated names. uci has no
+// syntax for an empty list, list options without values are not written
+func WriteUci(w io.Writer, data *UciPackageData) error {
+	writer := bufio.NewWriter(w)
+
+	for i := range data.Sections {
+		if i > 0 {
+			writer.WriteString("\n")
+		}
+		_WriteUciSection(writer, &data.Sections[i])
+	}
+
+	return writer.Flush()
+}
+
+func WriteUciSection(w io.Writer, section *UciSectionData) error {
+	writer := bufio.NewWriter(w)
+	_WriteUciSection(writer, section)
+	return writer.Flush()
+}
+
+func _WriteUciSection(writer *bufio.Writer, section *UciSectionData) {
+	writer.WriteString("config ")
+	writer.WriteString(section.Type)
+	if !section.Anonymous && section.Name != "" {
+		writer.WriteString(" ")
+		writer.WriteString(_QuoteUci(section.Name))
+	}
+	writer.WriteString("\n")
+
+	for _, option := range section.Options {
+		switch option.Type {
+		case UCI_TYPE_STRING:
+			writer.WriteString("\toption " + option.Name + " " + _QuoteUci(option.Value) + "\n")
+		case UCI_TYPE_LIST:
+			for _, value := range option.Values {
+				writer.WriteString("\tlist " + option.Name + " " + _QuoteUci(value) + "\n")
+			}
+		}
+	}
+}
+
+func (data *UciPackageData) String() string {
+	var builder strings.Builder
+	WriteUci(&builder, data)
+	return builder.String()
+}
+
+// copy of data that writes the same for equal configurations: options sorted
+// by name, names of anonymous sections and list options without values
+// dropped. section and list order is kept since it is meaningful to uci
+func (data *UciPackageData) Canonicalize() *UciPackageData {
+	canonical := data.Clone()
+
+	for i := range canonical.Sections {
+		section := &canonical.Sections[i]
+		if section.Anonymous {
+			section.Name = ""
+		}
+
+		options := section.Options[:0]
+		for _, option := range section.Options {
+			if option.Type == UCI_TYPE_LIST && len(option.Values) == 0 {
+				continue
+			}
+			options = append(options, option)
+		}
+		section.Options = options
+
+		sort.SliceStable(section.Options, func(i, j int) bool {
+			return section.Options[i].Name < section.Options[j].Name
+		})
+	}
+
+	return canonical
+}
+
+// parse uci text from r and write its canonical form to w
+func CanonicalizeUci(r io.Reader, w io.Writer) error {
+	data, err := ParseUci("", r)
+	if err != nil {
+		return err
+	}
+
+	return WriteUci(w, data.Canonicalize())
+}
@@ -0,0 +1,97 @@
+package openwrt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeUci(t *testing.T) {
+	a := `
+config interface "lan"
+	option proto static
+	option ipaddr   '192.168.1.1'   # router
+	list dns 8.8.8.8
+	list dns "1.1.1.1"
+
+config rule
+config rule
+	option name 'it'\''s'
+`
+	b := `
+config interface 'lan'
+	list dns '8.8.8.8'
+	option ipaddr '192.168.1.1'
+	list dns '1.1.1.1'
+	option proto 'static'
+config rule
+config rule
+	option name "it's"
+`
+
+	var outA, outB strings.Builder
+	if err := CanonicalizeUci(strings.NewReader(a), &outA); err != nil {
+		t.Fatal(err)
+	}
+	if err := CanonicalizeUci(strings.NewReader(b), &outB); err != nil {
+		t.Fatal(err)
+	}
+
+	if outA.String() != outB.String() {
+		t.Errorf("canonical forms differ:\n%s\n---\n%s", outA.String(), outB.String())
+	}
+
+	expected := `config interface 'lan'
+	list dns '8.8.8.8'
+	list dns '1.1.1.1'
+	option ipaddr '192.168.1.1'
+	option proto 'static'
+
+config rule
+
+config rule
+	option name 'it'\''s'
+`
+	if outA.String() != expected {
+		t.Errorf("unexpected canonical form:\n%s", outA.String())
+	}
+
+	// the output parses back to the same package
+	data, err := ParseUciString("", outA.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.String() != expected {
+		t.Errorf("round trip differs:\n%s", data.String())
+	}
+}
+
+func TestCanonicalizeEmptyList(t *testing.T) {
+	data := &UciPackageData{
+		Name: "network",
+		Sections: []UciSectionData{{
+			Name: "lan",
+			Type: "interface",
+			Options: []UciOptionData{
+				{Name: "dns", Type: UCI_TYPE_LIST},
+				{Name: "proto", Type: UCI_TYPE_STRING, Value: "static"},
+			},
+		}},
+	}
+
+	canonical := data.Canonicalize()
+	if len(canonical.Sections[0].Options) != 1 || canonical.Sections[0].Options[0].Name != "proto" {
+		t.Fatalf("expect the empty list to be dropped, got %v", canonical.Sections[0].Options)
+	}
+	if len(data.Sections[0].Options) != 2 {
+		t.Fatal("canonicalize changed its input")
+	}
+
+	// written text parses back to the canonical form
+	parsed, err := ParseUciString("network", data.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != canonical.String() || len(parsed.Sections[0].Options) != 1 {
+		t.Errorf("round trip differs:\n%s\n---\n%s", parsed.String(), canonical.String())
+	}
+}
@@ -1,13 +1,67 @@
+//go:build cgo && !ubus_native
+
 package openwrt
 
 /*
+#include <signal.h>
 #include <libubox/uloop.h>
+
+extern void uloop_queue_stub(struct uloop_fd *fd, unsigned int events);
+
+// uloop_run installs its own handlers for these, replacing the ones of go
+static const int uloop_signals[] = { SIGINT, SIGTERM, SIGCHLD, SIGPIPE };
+static struct sigaction uloop_saved_signals[4];
+
+static void uloop_save_signals(void)
+{
+	for (int i = 0; i < 4; i++)
+		sigaction(uloop_signals[i], NULL, &uloop_saved_signals[i]);
+}
+
+static void uloop_restore_signals(void)
+{
+	for (int i = 0; i < 4; i++)
+		sigaction(uloop_signals[i], &uloop_saved_signals[i], NULL);
+}
+
+static struct uloop_fd queue_fd;
+
+static int uloop_queue_add(int fd)
+{
+	queue_fd.fd = fd;
+	queue_fd.cb = uloop_queue_stub;
+	return uloop_fd_add(&queue_fd, ULOOP_READ);
+}
 */
 import "C"
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// work posted to the uloop thread, woken up through a pipe
+	uloopQueue      []func()
+	uloopQueueMutex sync.Mutex
+	uloopQueueFds   = [2]int{-1, -1}
+
+	// the thread started by uloopStart, 0 if there is none
+	uloopThread     atomic.Int32
+	uloopThreadOnce sync.Once
+	uloopThreadErr  error
+)
 
 func UloopInit() error {
 	_, err := C.uloop_init()
-	return err
+	if err != nil {
+		return err
+	}
+
+	return uloopQueueInit()
 }
 
 func UloopRun() error {
@@ -19,3 +73,139 @@ func UloopDone() error {
 	_, err := C.uloop_done()
 	return err
 }
+
+func uloopQueueInit() error {
+	uloopQueueMutex.Lock()
+	defer uloopQueueMutex.Unlock()
+
+	if uloopQueueFds[0] >= 0 {
+		return nil
+	}
+
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return err
+	}
+
+	if ret := C.uloop_queue_add(C.int(fds[0])); ret != 0 {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return errors.New("ng: uloop_fd_add failed")
+	}
+
+	uloopQueueFds = fds
+	return nil
+}
+
+//export uloop_queue_stub
+func uloop_queue_stub(fd *C.struct_uloop_fd, events C.uint) {
+	buf := make([]byte, 64)
+	for {
+		if n, _ := syscall.Read(int(fd.fd), buf); n <= 0 {
+			break
+		}
+	}
+
+	uloopQueueMutex.Lock()
+	queue := uloopQueue
+	uloopQueue = nil
+	uloopQueueMutex.Unlock()
+
+	for _, fn := range queue {
+		fn()
+	}
+}
+
+// run fn on the uloop thread, the loop must have been set up by UloopInit
+func uloopPost(fn func()) error {
+	uloopQueueMutex.Lock()
+	if uloopQueueFds[1] < 0 {
+		uloopQueueMutex.Unlock()
+		return errors.New("ng: uloop is not initialized")
+	}
+	uloopQueue = append(uloopQueue, fn)
+	fd := uloopQueueFds[1]
+	uloopQueueMutex.Unlock()
+
+	// a full pipe already wakes up the loop
+	syscall.Write(fd, []byte{0})
+	return nil
+}
+
+/*
+run uloop on a goroutine locked to its own OS thread, once per process. the
+application must not call UloopRun then.
+
+signals stay with go, so os/signal keeps working: the handlers uloop_run
+installs for SIGINT, SIGTERM, SIGCHLD and SIGPIPE are replaced by the ones of
+go as soon as the loop serves its queue. a signal caught by uloop before that
+cancels uloop_run, it is raised again for go and the loop restarted. uloop
+processes are not reaped, the SIGCHLD handler of uloop is never active
+*/
+func uloopStart() error {
+	uloopThreadOnce.Do(func() {
+		ready := make(chan error)
+
+		go func() {
+			runtime.LockOSThread()
+
+			if err := UloopInit(); err != nil {
+				ready <- err
+				return
+			}
+			C.uloop_save_signals()
+			uloopThread.Store(int32(syscall.Gettid()))
+			ready <- nil
+
+			for {
+				// runs once uloop_run has set up its handlers
+				uloopPost(func() { C.uloop_restore_signals() })
+
+				// uloop_run returns the signal that cancelled it, if any
+				if sig, _ := C.uloop_run(); sig > 0 {
+					syscall.Kill(syscall.Getpid(), syscall.Signal(sig))
+				}
+			}
+		}()
+
+		uloopThreadErr = <-ready
+	})
+
+	return uloopThreadErr
+}
+
+// whether the caller is the goroutine of uloopStart
+func uloopOnThread() bool {
+	tid := uloopThread.Load()
+	return tid != 0 && tid == int32(syscall.Gettid())
+}
+
+// run fn on the uloop thread and wait for its result. fn is skipped if goCtx
+// is done before its turn, waiting stops when goCtx is done
+func _UloopCall[T any](goCtx context.Context, fn func() (T, error)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+
+	var zero T
+	done := make(chan result, 1)
+
+	err := uloopPost(func() {
+		var r result
+		if r.err = goCtx.Err(); r.err == nil {
+			r.v, r.err = fn()
+		}
+		done <- r
+	})
+	if err != nil {
+		return zero, err
+	}
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-goCtx.Done():
+		return zero, goCtx.Err()
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !cgo || ubus_native
+
+package openwrt
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// without libubox the ubus connections dispatch on their own goroutines,
+// UloopRun only blocks until SIGINT or SIGTERM like uloop_run does
+
+var uloopSignals chan os.Signal
+
+func UloopInit() error {
+	uloopSignals = make(chan os.Signal, 1)
+	return nil
+}
+
+func UloopRun() error {
+	if uloopSignals == nil {
+		UloopInit()
+	}
+
+	signal.Notify(uloopSignals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(uloopSignals)
+
+	<-uloopSignals
+	return nil
+}
+
+func UloopDone() error {
+	return nil
+}